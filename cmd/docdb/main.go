@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
 
 	"github.com/dmitsh/docdb/pkg/cosmosdb"
+	"github.com/dmitsh/docdb/pkg/memdb"
 	"github.com/dmitsh/docdb/pkg/mongodb"
 	"github.com/dmitsh/docdb/pkg/queries"
 	"github.com/pkg/errors"
@@ -35,12 +39,17 @@ func main() {
 func run() error {
 	var (
 		cfile, ifile, qfile string
+		expr                string
+		single, count       bool
 		db                  queries.DbInterface
 		visitor             queries.Visitor
 	)
 	flag.StringVar(&cfile, "c", "", "DB config filepath")
 	flag.StringVar(&ifile, "i", "", "input data filepath")
 	flag.StringVar(&qfile, "q", "", "query filepath")
+	flag.StringVar(&expr, "e", "", `query in the text syntax, e.g. 'state IN ("CA", "WA") ORDER BY person.name LIMIT 2'`)
+	flag.BoolVar(&single, "p", false, "fetch a single page and print the token of the next one")
+	flag.BoolVar(&count, "n", false, "print the number of matching documents only")
 	flag.Parse()
 
 	// read config
@@ -49,20 +58,27 @@ func run() error {
 		return err
 	}
 
+	// cancel in-flight operations on Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	switch config["type"] {
 	case "cosmosdb":
 		visitor = &cosmosdb.Query{}
-		db, err = cosmosdb.GetDB(config)
+		db, err = cosmosdb.GetDB(ctx, config)
 	case "mongodb":
 		visitor = &mongodb.Query{}
-		db, err = mongodb.GetDB(config)
+		db, err = mongodb.GetDB(ctx, config)
+	case "memory":
+		visitor = &memdb.Query{}
+		db, err = memdb.GetDB(ctx, config)
 	default:
 		err = errors.Errorf("Unsupported DB type %q", config["type"])
 	}
 	if err != nil {
 		return err
 	}
-	defer db.Disconnect()
+	defer disconnect(db)
 
 	switch {
 	case len(ifile) != 0:
@@ -70,14 +86,28 @@ func run() error {
 		if err != nil {
 			return err
 		}
-		return db.Populate(data)
+		return db.Populate(ctx, data)
 
-	case len(qfile) != 0:
-		return processQuery(qfile, db, visitor)
+	case len(qfile) != 0, len(expr) != 0:
+		mq, err := getQuery(qfile, expr)
+		if err != nil {
+			return err
+		}
+		codec := queries.NewTokenCodec(config["type"], []byte(config["tokenSecret"]))
+		return processQuery(ctx, mq, db, visitor, codec, single, count)
 	}
 	return nil
 }
 
+// disconnect uses its own context, as the main one might be already cancelled
+func disconnect(db queries.DbInterface) {
+	ctx, cancel := context.WithTimeout(context.Background(), queries.DefaultConnectTimeout)
+	defer cancel()
+	if err := db.Disconnect(ctx); err != nil {
+		fmt.Println("Disconnect error:", err.Error())
+	}
+}
+
 func getConfig(fname string) (map[string]string, error) {
 	if len(fname) == 0 {
 		return nil, errors.Errorf("Missing config file")
@@ -101,40 +131,88 @@ func getData(fname string) ([]interface{}, error) {
 	return data, err
 }
 
-func processQuery(fname string, db queries.DbInterface, visitor queries.Visitor) error {
+// getQuery reads the JSON query file or parses the text query
+func getQuery(fname, expr string) (*queries.MidQuery, error) {
+	if len(fname) != 0 && len(expr) != 0 {
+		return nil, errors.Errorf("Flags -q and -e are mutually exclusive")
+	}
+	if len(expr) != 0 {
+		mq, err := queries.ParseText(expr)
+		var serr *queries.SyntaxError
+		if errors.As(err, &serr) {
+			// point at the error in the offending line
+			line := strings.Split(expr, "\n")[serr.Line-1]
+			fmt.Println(line)
+			fmt.Println(strings.Repeat(" ", serr.Column-1) + "^")
+		}
+		return mq, err
+	}
 	data, err := os.ReadFile(fname)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var mq queries.MidQuery
 	if err = json.Unmarshal(data, &mq); err != nil {
-		return err
+		return nil, err
 	}
+	return &mq, nil
+}
+
+func processQuery(ctx context.Context, mq *queries.MidQuery, db queries.DbInterface, visitor queries.Visitor, codec *queries.TokenCodec, single, count bool) error {
 	//
 	qbuilder := queries.NewQueryBuilder(visitor)
-	err = qbuilder.BuildQuery(&mq)
+	err := qbuilder.BuildQuery(mq)
 
 	if err != nil {
 		return err
 	}
-	var (
-		ret   []interface{}
-		token string
-	)
-	for {
+	if count {
+		total, err := db.Count(ctx, visitor)
+		if err != nil {
+			return errors.Wrap(err, "processQuery")
+		}
+		fmt.Println("COUNT:", total)
+		return nil
+	}
+	if mq.Aggregate != nil {
+		fmt.Println("RUN AGGREGATION")
+		ret, err := db.Aggregate(ctx, visitor)
+		if err != nil {
+			return errors.Wrap(err, "processQuery")
+		}
+		for _, row := range ret {
+			jdata, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(jdata))
+		}
+		fmt.Println("EOF")
+		return nil
+	}
+	// the first page starts at the token from the query file, if any
+	pager := queries.NewPager(db, visitor, mq, codec)
+	for page := 0; !pager.Done(); page++ {
 		fmt.Println("RUN QUERY")
-		ret, token, err = db.RunQuery(visitor, token)
+		ret, err := pager.Next(ctx)
 		if err != nil {
 			return errors.Wrap(err, "processQuery")
 		}
+		if total, ok := pager.Total(); ok && page == 0 {
+			fmt.Println("TOTAL:", total)
+		}
 		for _, item := range ret {
 			printItem(item)
 		}
-		if len(ret) == 0 || len(token) == 0 {
-			fmt.Println("EOF")
+		if single {
 			break
 		}
 	}
+	if pager.Done() {
+		fmt.Println("EOF")
+	} else {
+		fmt.Println("NEXT TOKEN:", pager.Token())
+	}
 	return nil
 }
 
@@ -0,0 +1,154 @@
+// Package conformance holds the corpus of MidQuery cases, with the results expected
+// of every DbInterface implementation on the dataset from tests/dataset.json.
+// The corpus is run by package conformancetest from the tests of the backends.
+package conformance
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/dmitsh/docdb/pkg/queries"
+)
+
+// Backend is the pair of DB and query visitor under test
+type Backend struct {
+	DB         queries.DbInterface
+	NewVisitor func() queries.Visitor
+}
+
+// Case is a MidQuery with the expected result, identified by "person.name" of the matching documents
+type Case struct {
+	Name  string
+	Query string
+	// expected names; sorted alphabetically when the query has no sort order
+	Names []string
+	// expected rows of an aggregation, as a JSON array
+	Rows string
+}
+
+var Cases = []Case{
+	{
+		Name:  "all",
+		Query: `{}`,
+		Names: []string{"Ann", "Dave", "Jeniffer", "John", "Kate", "Leo", "Mike", "Nataly", "Nick", "Peter"},
+	},
+	{
+		Name:  "paginated",
+		Query: `{"pagination": {"limit": 3}}`,
+		Names: []string{"Ann", "Dave", "Jeniffer", "John", "Kate", "Leo", "Mike", "Nataly", "Nick", "Peter"},
+	},
+	{
+		Name:  "eq",
+		Query: `{"filter": {"EQ": {"state": "CA"}}, "pagination": {"limit": 2}}`,
+		Names: []string{"Dave", "Mike", "Nataly", "Nick"},
+	},
+	{
+		Name:  "eq number",
+		Query: `{"filter": {"EQ": {"person.code": 1005}}}`,
+		Names: []string{"Nick"},
+	},
+	{
+		Name:  "no match",
+		Query: `{"filter": {"EQ": {"state": "TX"}}, "pagination": {"limit": 2}}`,
+		Names: []string{},
+	},
+	{
+		Name:  "and in sorted",
+		Query: `{"filter": {"AND": [{"EQ": {"person.org": "A"}}, {"IN": {"state": ["CA", "WA"]}}]}, "sort": [{"key": "state", "order": "DESC"}, {"key": "person.name"}]}`,
+		Names: []string{"John", "Peter", "Mike"},
+	},
+	{
+		Name:  "or sorted paginated",
+		Query: `{"filter": {"OR": [{"EQ": {"person.org": "A"}}, {"AND": [{"EQ": {"person.org": "B"}}, {"IN": {"state": ["CA", "WA"]}}]}]}, "sort": [{"key": "state", "order": "DESC"}, {"key": "person.name"}], "pagination": {"limit": 2}}`,
+		Names: []string{"John", "Leo", "Peter", "Ann", "Mike", "Nick"},
+	},
+	{
+		Name:  "comparisons",
+		Query: `{"filter": {"AND": [{"NE": {"state": "CA"}}, {"GTE": {"city": "P"}}, {"LT": {"person.name": "M"}}]}, "sort": [{"key": "city"}]}`,
+		Names: []string{"Kate", "Leo", "John"},
+	},
+	{
+		// "rank" is missing on most documents and null on Kate's; NE matches both
+		Name:  "ne sparse",
+		Query: `{"filter": {"NE": {"rank": 3}}}`,
+		Names: []string{"Ann", "Dave", "Jeniffer", "John", "Kate", "Leo", "Mike", "Nataly", "Nick"},
+	},
+	{
+		Name:  "numeric range",
+		Query: `{"filter": {"AND": [{"GT": {"person.code": 1003}}, {"LTE": {"person.code": 1006}}]}, "sort": [{"key": "person.code", "order": "DESC"}], "pagination": {"limit": 2}}`,
+		Names: []string{"Jeniffer", "Nick", "John"},
+	},
+	{
+		Name:  "not",
+		Query: `{"filter": {"NOT": {"AND": [{"EQ": {"person.org": "A"}}, {"EQ": {"state": "WA"}}]}}, "sort": [{"key": "person.name"}], "pagination": {"limit": 4}}`,
+		Names: []string{"Ann", "Dave", "Jeniffer", "Kate", "Leo", "Mike", "Nataly", "Nick"},
+	},
+	{
+		Name:  "string matching",
+		Query: `{"filter": {"OR": [{"STARTSWITH": {"person.name": "j"}, "ignoreCase": true}, {"CONTAINS": {"city": "Diego"}}, {"REGEX": {"city": "^Los "}}]}, "sort": [{"key": "person.name"}]}`,
+		Names: []string{"Dave", "Jeniffer", "John", "Nick"},
+	},
+	{
+		// "zip" is set on Leo's and Ann's documents and null on Dave's
+		Name:  "existence",
+		Query: `{"filter": {"AND": [{"EXISTS": "person.org"}, {"NOT": {"ISNULL": "state"}}, {"NOT": {"ISDEFINED": "zip"}}, {"GT": {"person.code": 1003}}]}, "sort": [{"key": "person.code"}], "pagination": {"limit": 3}}`,
+		Names: []string{"John", "Nick", "Jeniffer", "Mike"},
+	},
+	{
+		Name:  "between",
+		Query: `{"filter": {"OR": [{"BETWEEN": {"person.code": {"gte": 1003, "lt": 1006}}}, {"BETWEEN": {"person.name": {"gt": "Leo", "lte": "Mike"}}}]}, "sort": [{"key": "person.code", "order": "DESC"}], "pagination": {"limit": 2}}`,
+		Names: []string{"Mike", "Nick", "John", "Nataly"},
+	},
+	{
+		// "rank" is set on a few documents only (null on Kate's); the null and missing
+		// values come last in descending order and must not be lost across the pages
+		Name:  "descending sparse",
+		Query: `{"sort": [{"key": "rank", "order": "DESC"}, {"key": "person.name"}], "pagination": {"limit": 2}}`,
+		Names: []string{"Peter", "Ann", "Nick", "Dave", "Jeniffer", "John", "Kate", "Leo", "Mike", "Nataly"},
+	},
+	{
+		Name:  "array contains",
+		Query: `{"filter": {"ARRAY_CONTAINS": {"tags": "vip"}}}`,
+		Names: []string{"Nick", "Peter"},
+	},
+	{
+		// Ann has a Seattle address, but not with a "+1" phone
+		Name:  "any",
+		Query: `{"filter": {"OR": [{"ANY": {"addresses": {"AND": [{"EQ": {"city": "Seattle"}}, {"ANY": {"phones": {"STARTSWITH": {"number": "+1"}}}}]}}}, {"ANY": {"addresses": {"EQ": {"city": "Portland"}}}}]}}`,
+		Names: []string{"Kate", "Peter"},
+	},
+	{
+		// the dates are stored with different time zones; Jeniffer's and Nataly's are the same instant
+		Name:  "dates",
+		Query: `{"filter": {"GTE": {"joined": {"$date": "2021-06-01"}}}, "sort": [{"key": "joined"}, {"key": "person.name"}], "pagination": {"limit": 2}}`,
+		Names: []string{"Jeniffer", "Nataly", "Leo", "Nick", "Mike"},
+	},
+	{
+		Name:  "date range",
+		Query: `{"filter": {"BETWEEN": {"joined": {"gt": {"$date": "2021-01-01"}, "lt": {"$date": "2021-06-01T00:00:00Z"}}}}}`,
+		Names: []string{"Kate", "Peter"},
+	},
+	{
+		Name:  "select",
+		Query: `{"select": ["person.name", "city"], "filter": {"EQ": {"state": "WA"}}, "sort": [{"key": "person.name"}], "pagination": {"limit": 2}}`,
+		Names: []string{"John", "Leo", "Peter"},
+	},
+	{
+		// "score" is missing on most documents, a string on Kate's and null on Dave's;
+		// SUM and AVG only take the numbers
+		Name:  "aggregate mixed types",
+		Query: `{"aggregate": {"groupBy": ["person.org"], "functions": [{"op": "COUNT", "as": "count"}, {"op": "SUM", "key": "score", "as": "sum"}, {"op": "AVG", "key": "score", "as": "avg"}]}, "sort": [{"key": "person_org"}]}`,
+		Rows:  `[{"person_org": "A", "count": 4, "sum": 16, "avg": 8}, {"person_org": "B", "count": 3, "sum": 5, "avg": 5}, {"person_org": "C", "count": 3, "sum": 0, "avg": null}]`,
+	},
+}
+
+// LoadDataset reads the JSON array of documents
+func LoadDataset(fname string) ([]interface{}, error) {
+	content, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	data := []interface{}{}
+	err = json.Unmarshal(content, &data)
+	return data, err
+}
@@ -0,0 +1,164 @@
+// Package conformancetest runs the conformance corpus against a backend from its tests
+package conformancetest
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmitsh/docdb/pkg/conformance"
+	"github.com/dmitsh/docdb/pkg/queries"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// metadata fields added by the backends
+var metadata = []string{"_id", "id", "_rid", "_self", "_etag", "_attachments", "_ts"}
+
+// Run populates the empty backend with the dataset and runs all cases against it
+func Run(t *testing.T, dataset string, backend conformance.Backend) {
+	data, err := conformance.LoadDataset(dataset)
+	require.NoError(t, err)
+	require.NoError(t, backend.DB.Populate(context.Background(), data))
+
+	// reload the dataset, as Populate may modify the documents
+	data, err = conformance.LoadDataset(dataset)
+	require.NoError(t, err)
+	docs := make(map[string]interface{})
+	for _, doc := range data {
+		// the backends store the dates in their own format; compare them as RFC 3339 strings
+		doc, err = queries.ConvertDates(doc, func(t time.Time) interface{} { return t.Format(time.RFC3339Nano) })
+		require.NoError(t, err)
+		doc = normalize(t, doc)
+		name, _ := queries.LookupPath(doc, "person.name")
+		docs[name.(string)] = doc
+	}
+
+	for _, c := range conformance.Cases {
+		t.Run(c.Name, func(t *testing.T) {
+			RunCase(t, backend, c, docs)
+		})
+	}
+}
+
+// RunCase runs a single case, draining all pages, and checks the result set,
+// the ordering, the page sizes, the returned documents and the count
+func RunCase(t *testing.T, backend conformance.Backend, c conformance.Case, docs map[string]interface{}) {
+	var mq queries.MidQuery
+	require.NoError(t, json.Unmarshal([]byte(c.Query), &mq))
+	visitor := backend.NewVisitor()
+	require.NoError(t, queries.NewQueryBuilder(visitor).BuildQuery(&mq))
+	if mq.Aggregate != nil {
+		runAggregate(t, backend, visitor, c)
+		return
+	}
+
+	names := []string{}
+	token := ""
+	for {
+		ret, next, err := backend.DB.RunQuery(context.Background(), visitor, token)
+		require.NoError(t, err)
+		if mq.Page.Limit > 0 {
+			assert.LessOrEqual(t, len(ret), mq.Page.Limit, "page size")
+		}
+		for _, item := range ret {
+			doc := normalize(t, item)
+			name, ok := queries.LookupPath(doc, "person.name")
+			require.True(t, ok, "document without person.name: %v", doc)
+			names = append(names, name.(string))
+			expected := docs[name.(string)]
+			if len(mq.Select) != 0 {
+				expected = project(expected, mq.Select)
+			}
+			assert.Equal(t, expected, doc)
+		}
+		if len(ret) == 0 || len(next) == 0 {
+			break
+		}
+		// only the last page can be incomplete
+		if mq.Page.Limit > 0 {
+			assert.Equal(t, mq.Page.Limit, len(ret), "page size")
+		}
+		token = next
+	}
+	if len(mq.Sort) == 0 {
+		sort.Strings(names)
+	}
+	assert.Equal(t, c.Names, names)
+
+	count, err := backend.DB.Count(context.Background(), visitor)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(c.Names)), count, "count")
+}
+
+// runAggregate checks the rows of an aggregation
+func runAggregate(t *testing.T, backend conformance.Backend, visitor queries.Visitor, c conformance.Case) {
+	var expected []interface{}
+	require.NoError(t, json.Unmarshal([]byte(c.Rows), &expected))
+	ret, err := backend.DB.Aggregate(context.Background(), visitor)
+	require.NoError(t, err)
+	rows := []interface{}{}
+	for _, row := range ret {
+		rows = append(rows, normalize(t, row))
+	}
+	assert.Equal(t, expected, rows)
+}
+
+// normalize strips backend metadata and converts the document to plain JSON types,
+// with the dates as RFC 3339 strings in UTC
+func normalize(t *testing.T, item interface{}) interface{} {
+	jdata, err := json.Marshal(item)
+	require.NoError(t, err)
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(jdata, &doc))
+	for _, key := range metadata {
+		delete(doc, key)
+	}
+	return canonicalDates(doc)
+}
+
+// canonicalDates rewrites the strings holding an RFC 3339 time in UTC,
+// as the backends return the dates in different time zones and precisions
+func canonicalDates(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, elem := range val {
+			val[k] = canonicalDates(elem)
+		}
+	case []interface{}:
+		for i, elem := range val {
+			val[i] = canonicalDates(elem)
+		}
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+			return t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return v
+}
+
+// project copies the selected fields of the document, keeping their nesting
+func project(doc interface{}, fields []string) interface{} {
+	ret := map[string]interface{}{}
+	for _, key := range fields {
+		val, ok := queries.LookupPath(doc, key)
+		if !ok {
+			continue
+		}
+		names := strings.Split(key, ".")
+		node := ret
+		for _, name := range names[:len(names)-1] {
+			child, ok := node[name].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[name] = child
+			}
+			node = child
+		}
+		node[names[len(names)-1]] = val
+	}
+	return ret
+}
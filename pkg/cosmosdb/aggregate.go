@@ -0,0 +1,218 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/a8m/documentdb"
+	"github.com/dmitsh/docdb/pkg/queries"
+	"github.com/pkg/errors"
+)
+
+var aggregateFunctions = map[string]string{
+	queries.SUM: "SUM",
+	queries.AVG: "AVG",
+	queries.MIN: "MIN",
+	queries.MAX: "MAX",
+}
+
+// Aggregate runs the GROUP BY query and returns all result rows. A cross-partition
+// query returns a partial row per group for every partition, so the rows are merged
+// here. Cosmos does not support ORDER BY together with GROUP BY, so the merged rows
+// are sorted and limited here as well.
+func (db *DB) Aggregate(ctx context.Context, q interface{}) ([]interface{}, error) {
+	query, ok := q.(*Query)
+	if !ok {
+		return nil, errors.Errorf("Unexpected query type %s", reflect.TypeOf(q).String())
+	}
+	if query.aggregate == nil {
+		return nil, errors.New("query has no aggregation")
+	}
+	ctx, cancel := queries.WithTimeout(ctx, db.timeouts.Query)
+	defer cancel()
+	ret := []interface{}{}
+	token := ""
+	for {
+		opts := []documentdb.CallOption{documentdb.CrossPartition(), withContext(ctx)}
+		if len(token) != 0 {
+			opts = append(opts, documentdb.Continuation(token))
+		}
+		docs := []interface{}{}
+		resp, err := db.client.QueryDocuments(db.collection.Self, &query.query, &docs, opts...)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, docs...)
+		if token = resp.Header.Get(documentdb.HeaderContinuation); len(token) == 0 {
+			break
+		}
+	}
+	ret = mergeRows(query.aggregate, ret)
+	queries.SortDocuments(ret, query.sort)
+	if query.limit > 0 && len(ret) > query.limit {
+		ret = ret[:query.limit]
+	}
+	return ret, nil
+}
+
+// finalizeAggregate builds
+//
+//	SELECT <key> AS <alias>, ..., <FUNC>(<key>) AS <alias>, ... FROM c WHERE ... GROUP BY <key>, ...
+func (q *Query) finalizeAggregate(filter string, mq *queries.MidQuery) error {
+	agg := mq.Aggregate
+	for _, alias := range agg.Aliases() {
+		if reservedWords[strings.ToUpper(alias)] {
+			return fmt.Errorf("aggregate alias %q is a reserved word", alias)
+		}
+	}
+	fields := []string{}
+	groups := []string{}
+	for _, key := range agg.GroupBy {
+		path, err := fieldPath(key)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, fmt.Sprintf("%s AS %s", path, queries.GroupAlias(key)))
+		groups = append(groups, path)
+	}
+	for _, f := range agg.Functions {
+		if f.Op == queries.COUNT {
+			fields = append(fields, fmt.Sprintf("COUNT(1) AS %s", f.As))
+			continue
+		}
+		path, err := fieldPath(f.Key)
+		if err != nil {
+			return err
+		}
+		// Cosmos SUM is undefined when any value is not a number, and COUNT counts
+		// all defined values, so both take only the numbers, like the other backends
+		number := fmt.Sprintf("IS_NUMBER(%s) ? %s : 0", path, path)
+		switch f.Op {
+		case queries.SUM:
+			fields = append(fields, fmt.Sprintf("SUM(%s) AS %s", number, f.As))
+			continue
+		case queries.AVG:
+			// partial averages cannot be merged, so the average is computed from the merged sum and count
+			fields = append(fields, fmt.Sprintf("SUM(%s) AS %s, SUM(IS_NUMBER(%s) ? 1 : 0) AS %s", number, sumAlias(f), path, countAlias(f)))
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s(%s) AS %s", aggregateFunctions[f.Op], path, f.As))
+	}
+	aliases := agg.Aliases()
+	for _, f := range agg.Functions {
+		if f.Op != queries.AVG {
+			continue
+		}
+		for _, alias := range aliases {
+			if alias == sumAlias(f) || alias == countAlias(f) {
+				return fmt.Errorf("aggregate alias %q is reserved for the average %q", alias, f.As)
+			}
+		}
+	}
+	for _, s := range mq.Sort {
+		found := false
+		for _, alias := range aliases {
+			found = found || alias == s.Key
+		}
+		if !found {
+			return fmt.Errorf("sort key %q is not a field of the aggregation", s.Key)
+		}
+	}
+	q.sort = mq.Sort
+	groupBy := ""
+	if len(groups) != 0 {
+		groupBy = " GROUP BY " + strings.Join(groups, ", ")
+	}
+	q.query.Query = fmt.Sprintf("SELECT %s FROM c%s%s", strings.Join(fields, ", "), filter, groupBy)
+	return nil
+}
+
+func sumAlias(f queries.Aggregate) string   { return f.As + "__sum" }
+func countAlias(f queries.Aggregate) string { return f.As + "__count" }
+
+// mergeRows combines the partial rows of the same group: counts and sums are added
+// up, MIN and MAX take the extreme non-null value, and AVG is the merged sum divided
+// by the merged count. The groups keep the order of their first row.
+func mergeRows(agg *queries.Aggregation, rows []interface{}) []interface{} {
+	ret := []interface{}{}
+	index := map[string]map[string]interface{}{}
+	for _, r := range rows {
+		row, ok := r.(map[string]interface{})
+		if !ok {
+			ret = append(ret, r)
+			continue
+		}
+		key := groupKey(agg, row)
+		merged, found := index[key]
+		if !found {
+			index[key] = row
+			ret = append(ret, row)
+			continue
+		}
+		for _, f := range agg.Functions {
+			switch f.Op {
+			case queries.COUNT, queries.SUM:
+				mergeSum(merged, row, f.As)
+			case queries.AVG:
+				mergeSum(merged, row, sumAlias(f))
+				mergeSum(merged, row, countAlias(f))
+			case queries.MIN, queries.MAX:
+				val := row[f.As]
+				if val == nil {
+					continue
+				}
+				cmp := queries.CompareValues(val, merged[f.As])
+				if merged[f.As] == nil || (f.Op == queries.MIN && cmp < 0) || (f.Op == queries.MAX && cmp > 0) {
+					merged[f.As] = val
+				}
+			}
+		}
+	}
+	for _, r := range ret {
+		row, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, f := range agg.Functions {
+			if f.Op != queries.AVG {
+				continue
+			}
+			sum, _ := queries.ToFloat(row[sumAlias(f)])
+			count, _ := queries.ToFloat(row[countAlias(f)])
+			if count == 0 {
+				row[f.As] = nil
+			} else {
+				row[f.As] = sum / count
+			}
+			delete(row, sumAlias(f))
+			delete(row, countAlias(f))
+		}
+	}
+	return ret
+}
+
+// groupKey encodes the group values of the row; a missing value differs from null
+func groupKey(agg *queries.Aggregation, row map[string]interface{}) string {
+	keys := make([]interface{}, len(agg.GroupBy))
+	for i, key := range agg.GroupBy {
+		if val, found := row[queries.GroupAlias(key)]; found {
+			keys[i] = []interface{}{val}
+		}
+	}
+	data, _ := json.Marshal(keys)
+	return string(data)
+}
+
+func mergeSum(merged, row map[string]interface{}, alias string) {
+	val, ok := queries.ToFloat(row[alias])
+	if !ok {
+		return
+	}
+	if sum, ok := queries.ToFloat(merged[alias]); ok {
+		val += sum
+	}
+	merged[alias] = val
+}
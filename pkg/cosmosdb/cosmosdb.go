@@ -1,10 +1,16 @@
 package cosmosdb
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/a8m/documentdb"
 	"github.com/dmitsh/docdb/pkg/queries"
@@ -16,30 +22,40 @@ type DB struct {
 	key    string
 	dbName string
 	cName  string
+	pkPath string
+
+	timeouts queries.Timeouts
 
 	client     *documentdb.DocumentDB
 	collection *documentdb.Collection
 }
 
-type UserData interface{}
-
-type DocData struct {
-	documentdb.Document
-	UserData
-}
-
 type Query struct {
 	query documentdb.Query
+	count documentdb.Query // SELECT VALUE COUNT(1) with the same filter
 	limit int
+
+	aggregate *queries.Aggregation // set when the query has an aggregation
+	sort      []queries.Sorting    // order of the aggregation rows
+
+	depth int // nesting level of the ANY filters being visited
 }
 
-func GetDB(cfg map[string]string) (queries.DbInterface, error) {
+func GetDB(ctx context.Context, cfg map[string]string) (queries.DbInterface, error) {
+	var err error
 	db := &DB{
 		url:    cfg["url"],
 		key:    cfg["key"],
 		dbName: cfg["db"],
 		cName:  cfg["container"],
+		pkPath: cfg["partitionKey"],
+	}
+	if db.timeouts, err = queries.GetTimeouts(cfg); err != nil {
+		return nil, err
 	}
+	ctx, cancel := queries.WithTimeout(ctx, db.timeouts.Connect)
+	defer cancel()
+
 	db.client = documentdb.New(db.url, &documentdb.Config{
 		MasterKey: &documentdb.Key{
 			Key: db.key,
@@ -50,7 +66,7 @@ func GetDB(cfg map[string]string) (queries.DbInterface, error) {
 		Parameters: []documentdb.Parameter{
 			{Name: "@id", Value: db.dbName},
 		},
-	})
+	}, withContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -65,7 +81,7 @@ func GetDB(cfg map[string]string) (queries.DbInterface, error) {
 		Parameters: []documentdb.Parameter{
 			{Name: "@id", Value: db.cName},
 		},
-	})
+	}, withContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -76,30 +92,98 @@ func GetDB(cfg map[string]string) (queries.DbInterface, error) {
 	return db, nil
 }
 
-func (db *DB) Populate(data []interface{}) error {
-	for _, entry := range data {
-		doc := &DocData{UserData: entry}
-		jsonbytes, err := json.Marshal(doc)
+// Populate upserts the documents into the container. Documents without "id", or
+// with a null or empty one, get a generated id. When the partition key path
+// (e.g. "/state") is configured, its value is read from each document and sent
+// along with the request. The time literals {"$date": "..."} of the documents are
+// stored as strings in queries.CosmosTimeFormat (see setNextParamter). Failures do
+// not stop the remaining upserts; they are returned together in the error, one
+// entry per failed document.
+func (db *DB) Populate(ctx context.Context, data []interface{}) error {
+	failed := []string{}
+	for i, entry := range data {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := db.upsert(ctx, entry); err != nil {
+			failed = append(failed, fmt.Sprintf("document %d: %v", i, err))
+		}
+	}
+	if len(failed) != 0 {
+		return errors.Errorf("failed to upsert %d of %d documents: %s", len(failed), len(data), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (db *DB) upsert(ctx context.Context, entry interface{}) error {
+	if _, ok := entry.(map[string]interface{}); !ok {
+		return errors.Errorf("unexpected document type %T; expected JSON object", entry)
+	}
+	converted, err := queries.ConvertDates(entry, func(t time.Time) interface{} { return t.Format(queries.CosmosTimeFormat) })
+	if err != nil {
+		return err
+	}
+	doc := converted.(map[string]interface{})
+	if id := doc["id"]; id == nil || id == "" {
+		uuid, err := newID()
 		if err != nil {
 			return err
 		}
-		fmt.Println(string(jsonbytes))
-		/*fmt.Printf("ADD %#v\n", doc)
-		resp, err := client.UpsertDocument(colls.Self, &doc)
+		doc["id"] = uuid
+	} else if _, ok := id.(string); !ok {
+		return errors.Errorf("document id must be a string, got %T", id)
+	}
+	ctx, cancel := queries.WithTimeout(ctx, db.timeouts.Write)
+	defer cancel()
+	opts := []documentdb.CallOption{withContext(ctx)}
+	if len(db.pkPath) != 0 {
+		pk, err := partitionKey(doc, db.pkPath)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("RESP: %#v\n", resp)*/
+		opts = append(opts, documentdb.PartitionKey(pk))
 	}
-	return nil
+	_, err = db.client.UpsertDocument(db.collection.Self, doc, opts...)
+	return err
 }
 
-func (db *DB) RunQuery(q interface{}, token string) ([]interface{}, string, error) {
+// partitionKey extracts the value at the partition key path, e.g. "/person/org"
+func partitionKey(doc map[string]interface{}, path string) (interface{}, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.Errorf("invalid partition key path %q", path)
+	}
+	var val interface{} = doc
+	for _, field := range strings.Split(path[1:], "/") {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("document has no partition key %s", path)
+		}
+		if val, ok = m[field]; !ok {
+			return nil, errors.Errorf("document has no partition key %s", path)
+		}
+	}
+	return val, nil
+}
+
+// newID generates a random (version 4) UUID
+func newID() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return "", err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
+
+func (db *DB) RunQuery(ctx context.Context, q interface{}, token string) ([]interface{}, string, error) {
 	query, ok := q.(*Query)
 	if !ok {
 		return nil, "", errors.Errorf("Unexpected query type %s", reflect.TypeOf(q).String())
 	}
-	opts := []documentdb.CallOption{documentdb.CrossPartition()}
+	ctx, cancel := queries.WithTimeout(ctx, db.timeouts.Query)
+	defer cancel()
+	opts := []documentdb.CallOption{documentdb.CrossPartition(), withContext(ctx)}
 	if query.limit != 0 {
 		opts = append(opts, documentdb.Limit(query.limit))
 	}
@@ -116,104 +200,493 @@ func (db *DB) RunQuery(q interface{}, token string) ([]interface{}, string, erro
 	return docs, token, nil
 }
 
-func (db *DB) Disconnect() error {
+// Count counts the documents matching the filter of the query. A cross-partition
+// query may return a partial count per partition, so all returned counts are summed up.
+func (db *DB) Count(ctx context.Context, q interface{}) (int64, error) {
+	query, ok := q.(*Query)
+	if !ok {
+		return 0, errors.Errorf("Unexpected query type %s", reflect.TypeOf(q).String())
+	}
+	ctx, cancel := queries.WithTimeout(ctx, db.timeouts.Query)
+	defer cancel()
+	var total int64
+	token := ""
+	for {
+		opts := []documentdb.CallOption{documentdb.CrossPartition(), withContext(ctx)}
+		if len(token) != 0 {
+			opts = append(opts, documentdb.Continuation(token))
+		}
+		counts := []int64{}
+		resp, err := db.client.QueryDocuments(db.collection.Self, &query.count, &counts, opts...)
+		if err != nil {
+			return 0, err
+		}
+		for _, count := range counts {
+			total += count
+		}
+		if token = resp.Header.Get(documentdb.HeaderContinuation); len(token) == 0 {
+			return total, nil
+		}
+	}
+}
+
+func (db *DB) Disconnect(ctx context.Context) error {
 	return nil
 }
 
-func (q *Query) setNextParamter(val string) string {
-	pname := fmt.Sprintf("@__param__%d__", len(q.query.Parameters))
-	q.query.Parameters = append(q.query.Parameters, documentdb.Parameter{Name: pname, Value: val})
-	return pname
+// withContext binds the HTTP request to the context
+func withContext(ctx context.Context) documentdb.CallOption {
+	return func(r *documentdb.Request) error {
+		r.Request = r.Request.WithContext(ctx)
+		return nil
+	}
 }
 
-func (q *Query) VisitEQ(f *queries.FilterEQ) (string, error) {
+// jsonNumber is the number grammar of JSON, which Cosmos SQL shares for its literals
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// setNextParamter binds the value to the query. Strings are passed as parameters;
+// numbers, booleans and null are emitted as SQL literals, because documentdb.Parameter
+// can only carry string values and would turn them into strings. Dates are passed as
+// UTC strings in the format recommended by Cosmos (see queries.CosmosTimeFormat).
+// Cosmos compares these strings character by character, so the time filters are only
+// correct on fields stored in exactly that format: UTC, with seven fractional digits.
+// Populate stores the {"$date": "..."} values of the documents that way; timestamps
+// written by other clients with another precision or offset do not compare correctly.
+// Infinity and NaN have no SQL literal and are rejected.
+func (q *Query) setNextParamter(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "null", nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case float64:
+		if math.IsInf(val, 0) || math.IsNaN(val) {
+			return "", fmt.Errorf("invalid number %v", val)
+		}
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	case float32:
+		if math.IsInf(float64(val), 0) || math.IsNaN(float64(val)) {
+			return "", fmt.Errorf("invalid number %v", val)
+		}
+		return strconv.FormatFloat(float64(val), 'f', -1, 32), nil
+	case json.Number:
+		if !jsonNumber.MatchString(val.String()) {
+			return "", fmt.Errorf("invalid number %q", val.String())
+		}
+		if _, err := val.Float64(); err != nil {
+			return "", fmt.Errorf("invalid number %q", val.String())
+		}
+		return val.String(), nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", val), nil
+	case queries.Date:
+		return q.setNextParamter(val.Time.UTC().Format(queries.CosmosTimeFormat))
+	case string:
+		pname := fmt.Sprintf("@__param__%d__", len(q.query.Parameters))
+		q.query.Parameters = append(q.query.Parameters, documentdb.Parameter{Name: pname, Value: val})
+		return pname, nil
+	default:
+		return "", fmt.Errorf("unsupported type of value %#v", v)
+	}
+}
+
+func (q *Query) VisitEQ(f *queries.FilterEQ) (interface{}, error) {
+	if str, ok := f.Val.(string); ok && f.IgnoreCase {
+		// StringEquals(<key>, <val>, true)
+		return q.visitFunction("StringEquals", f.Key, str, "true")
+	}
 	// <key> = <val>
-	val, ok := f.Val.(string)
-	if !ok {
-		return "", fmt.Errorf("unsupported type of value %#v; expected string", f.Val)
+	return q.visitComparison("=", f.Key, f.Val)
+}
+
+func (q *Query) VisitNE(f *queries.FilterNE) (interface{}, error) {
+	// (NOT IS_DEFINED(<key>) OR <key> != <val>); like $ne in Mongo, NE also matches
+	// documents without the field, for which the comparison alone is undefined
+	path, err := q.path(f.Key)
+	if err != nil {
+		return nil, err
+	}
+	name, err := q.setNextParamter(f.Val)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("(NOT IS_DEFINED(%s) OR %s != %s)", path, path, name), nil
+}
+
+func (q *Query) VisitGT(f *queries.FilterGT) (interface{}, error) {
+	// <key> > <val>
+	return q.visitComparison(">", f.Key, f.Val)
+}
+
+func (q *Query) VisitGTE(f *queries.FilterGTE) (interface{}, error) {
+	// <key> >= <val>
+	return q.visitComparison(">=", f.Key, f.Val)
+}
+
+func (q *Query) VisitLT(f *queries.FilterLT) (interface{}, error) {
+	// <key> < <val>
+	return q.visitComparison("<", f.Key, f.Val)
+}
+
+func (q *Query) VisitLTE(f *queries.FilterLTE) (interface{}, error) {
+	// <key> <= <val>
+	return q.visitComparison("<=", f.Key, f.Val)
+}
+
+func (q *Query) visitComparison(op, key string, v interface{}) (interface{}, error) {
+	path, err := q.path(key)
+	if err != nil {
+		return nil, err
+	}
+	name, err := q.setNextParamter(v)
+	if err != nil {
+		return nil, err
 	}
-	name := q.setNextParamter(val)
-	return fmt.Sprintf("c.%s = %s", f.Key, name), nil
+	return fmt.Sprintf("%s %s %s", path, op, name), nil
 }
 
-func (q *Query) VisitIN(f *queries.FilterIN) (string, error) {
+func (q *Query) VisitSTARTSWITH(f *queries.FilterSTARTSWITH) (interface{}, error) {
+	// STARTSWITH(<key>, <val>[, true])
+	return q.visitFunction("STARTSWITH", f.Key, f.Val, ignoreCase(f.IgnoreCase, "true"))
+}
+
+func (q *Query) VisitCONTAINS(f *queries.FilterCONTAINS) (interface{}, error) {
+	// CONTAINS(<key>, <val>[, true])
+	return q.visitFunction("CONTAINS", f.Key, f.Val, ignoreCase(f.IgnoreCase, "true"))
+}
+
+func (q *Query) VisitREGEX(f *queries.FilterREGEX) (interface{}, error) {
+	// RegexMatch(<key>, <pattern>[, "i"])
+	return q.visitFunction("RegexMatch", f.Key, f.Pattern, ignoreCase(f.IgnoreCase, `"i"`))
+}
+
+func (q *Query) VisitEXISTS(f *queries.FilterEXISTS) (interface{}, error) {
+	// IS_DEFINED(<key>)
+	return q.visitCheck("IS_DEFINED", f.Key)
+}
+
+func (q *Query) VisitISNULL(f *queries.FilterISNULL) (interface{}, error) {
+	// IS_NULL(<key>); false for undefined fields
+	return q.visitCheck("IS_NULL", f.Key)
+}
+
+func (q *Query) visitCheck(fn, key string) (interface{}, error) {
+	path, err := q.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("%s(%s)", fn, path), nil
+}
+
+// visitFunction calls the string function with the field, the value and the optional modifier
+func (q *Query) visitFunction(fn, key, v, modifier string) (interface{}, error) {
+	path, err := q.path(key)
+	if err != nil {
+		return nil, err
+	}
+	name, err := q.setNextParamter(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(modifier) != 0 {
+		return fmt.Sprintf("%s(%s, %s, %s)", fn, path, name, modifier), nil
+	}
+	return fmt.Sprintf("%s(%s, %s)", fn, path, name), nil
+}
+
+// ignoreCase returns the case-insensitivity modifier of a string function, if set
+func ignoreCase(set bool, modifier string) string {
+	if set {
+		return modifier
+	}
+	return ""
+}
+
+func (q *Query) VisitBETWEEN(f *queries.FilterBETWEEN) (interface{}, error) {
+	// <key> BETWEEN <lower> AND <upper>, when both bounds are inclusive;
+	// otherwise (<key> >(=) <lower> AND <key> <(=) <upper>)
+	path, err := q.path(f.Key)
+	if err != nil {
+		return nil, err
+	}
+	lower, err := q.setNextParamter(f.Lower)
+	if err != nil {
+		return nil, err
+	}
+	upper, err := q.setNextParamter(f.Upper)
+	if err != nil {
+		return nil, err
+	}
+	if f.LowerInclusive && f.UpperInclusive {
+		return fmt.Sprintf("%s BETWEEN %s AND %s", path, lower, upper), nil
+	}
+	lop, uop := ">", "<"
+	if f.LowerInclusive {
+		lop = ">="
+	}
+	if f.UpperInclusive {
+		uop = "<="
+	}
+	return fmt.Sprintf("(%s %s %s AND %s %s %s)", path, lop, lower, path, uop, upper), nil
+}
+
+func (q *Query) VisitARRAYCONTAINS(f *queries.FilterARRAYCONTAINS) (interface{}, error) {
+	// ARRAY_CONTAINS(<key>, <val>)
+	path, err := q.path(f.Key)
+	if err != nil {
+		return nil, err
+	}
+	name, err := q.setNextParamter(f.Val)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("ARRAY_CONTAINS(%s, %s)", path, name), nil
+}
+
+func (q *Query) VisitANY(f *queries.FilterANY) (interface{}, error) {
+	// EXISTS(SELECT VALUE t FROM t IN <key> WHERE <expression>)
+	path, err := q.path(f.Key)
+	if err != nil {
+		return nil, err
+	}
+	q.depth++
+	defer func() { q.depth-- }()
+	alias := q.alias()
+	str, err := q.visitFilter(f.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("EXISTS(SELECT VALUE %s FROM %s IN %s WHERE %s)", alias, alias, path, str), nil
+}
+
+// alias names the document "c", or the array element within the ANY filters: "t", "t1", ...
+func (q *Query) alias() string {
+	switch q.depth {
+	case 0:
+		return "c"
+	case 1:
+		return "t"
+	default:
+		return fmt.Sprintf("t%d", q.depth-1)
+	}
+}
+
+// path resolves the key against the document, or the array element within ANY
+func (q *Query) path(key string) (string, error) {
+	return propertyPath(q.alias(), key)
+}
+
+func (q *Query) VisitIN(f *queries.FilterIN) (interface{}, error) {
 	// <key> IN ( <val1>, <val2>, ... , <valN> )
 	if len(f.Vals) == 0 {
-		return "", fmt.Errorf("empty IN operator for key %q", f.Key)
+		return nil, fmt.Errorf("empty IN operator for key %q", f.Key)
+	}
+	path, err := q.path(f.Key)
+	if err != nil {
+		return nil, err
 	}
 	names := make([]string, len(f.Vals))
 	for i, v := range f.Vals {
-		val, ok := v.(string)
-		if !ok {
-			return "", fmt.Errorf("unsupported type of value %#v; expected string", v)
+		name, err := q.setNextParamter(v)
+		if err != nil {
+			return nil, err
 		}
-		names[i] = q.setNextParamter(val)
+		names[i] = name
 	}
-	return fmt.Sprintf("c.%s IN (%s)", f.Key, strings.Join(names, ", ")), nil
+	return fmt.Sprintf("%s IN (%s)", path, strings.Join(names, ", ")), nil
 }
 
-func (q *Query) visitFilters(op string, filters []queries.Filter) (string, error) {
+func (q *Query) visitFilters(op string, filters []queries.Filter) (interface{}, error) {
 	arr := []string{}
 	for _, filter := range filters {
-		switch f := filter.(type) {
-		case *queries.FilterEQ:
-			if str, err := q.VisitEQ(f); err != nil {
-				return "", err
-			} else {
-				arr = append(arr, str)
-			}
-		case *queries.FilterIN:
-			if str, err := q.VisitIN(f); err != nil {
-				return "", err
-			} else {
-				arr = append(arr, str)
-			}
-		case *queries.FilterOR:
-			if str, err := q.VisitOR(f); err != nil {
-				return "", err
-			} else {
-				arr = append(arr, "("+str+")")
-			}
-		case *queries.FilterAND:
-			if str, err := q.VisitAND(f); err != nil {
-				return "", err
-			} else {
-				arr = append(arr, "("+str+")")
-			}
-		default:
-			return "", fmt.Errorf("Unsupported filter type %#v", f)
+		str, err := q.visitFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		switch filter.(type) {
+		case *queries.FilterOR, *queries.FilterAND:
+			str = "(" + str + ")"
 		}
+		arr = append(arr, str)
 	}
 	return strings.Join(arr, " "+op+" "), nil
 }
 
-func (q *Query) VisitAND(f *queries.FilterAND) (string, error) {
+func (q *Query) visitFilter(filter queries.Filter) (string, error) {
+	ret, err := queries.VisitFilter(q, filter)
+	if err != nil {
+		return "", err
+	}
+	str, ok := ret.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected filter expression %#v", ret)
+	}
+	return str, nil
+}
+
+func (q *Query) VisitAND(f *queries.FilterAND) (interface{}, error) {
 	// <expression1> AND <expression2> AND ... AND <expressionN>
 	return q.visitFilters("AND", f.Filters)
 }
 
-func (q *Query) VisitOR(f *queries.FilterOR) (string, error) {
+func (q *Query) VisitOR(f *queries.FilterOR) (interface{}, error) {
 	// <expression1> OR <expression2> OR ... OR <expressionN>
 	return q.visitFilters("OR", f.Filters)
 }
 
-func (q *Query) Finalize(filters string, mq *queries.MidQuery) error {
+func (q *Query) VisitNOT(f *queries.FilterNOT) (interface{}, error) {
+	// NOT (<expression>)
+	str, err := q.visitFilter(f.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("NOT (%s)", str), nil
+}
+
+func (q *Query) Finalize(filters interface{}, mq *queries.MidQuery) error {
 	var filter, orderBy string
-	if len(filters) != 0 {
-		filter = fmt.Sprintf(" WHERE %s", filters)
+	if filters != nil {
+		str, ok := filters.(string)
+		if !ok {
+			return fmt.Errorf("unexpected filter expression %#v", filters)
+		}
+		filter = fmt.Sprintf(" WHERE %s", str)
+	}
+	q.count = documentdb.Query{
+		Query:      fmt.Sprintf("SELECT VALUE COUNT(1) FROM c%s", filter),
+		Parameters: q.query.Parameters,
+	}
+	q.aggregate = mq.Aggregate
+	q.sort = nil
+	q.limit = mq.Page.Limit
+	if q.aggregate != nil {
+		return q.finalizeAggregate(filter, mq)
 	}
 	if sz := len(mq.Sort); sz != 0 {
 		order := make([]string, sz)
 		for i, item := range mq.Sort {
+			path, err := fieldPath(item.Key)
+			if err != nil {
+				return err
+			}
 			if item.Order == queries.DESC {
-				order[i] = fmt.Sprintf("c.%s DESC", item.Key)
+				order[i] = fmt.Sprintf("%s DESC", path)
 			} else {
-				order[i] = fmt.Sprintf("c.%s ASC", item.Key)
+				order[i] = fmt.Sprintf("%s ASC", path)
 			}
 		}
 		orderBy = fmt.Sprintf(" ORDER BY %s", strings.Join(order, ", "))
 	}
-	q.query.Query = fmt.Sprintf("SELECT * FROM c%s%s", filter, orderBy)
-	q.limit = mq.Page.Limit
+	projection := "*"
+	if len(mq.Select) != 0 {
+		value, err := selectValue(mq.Select)
+		if err != nil {
+			return err
+		}
+		projection = "VALUE " + value
+	}
+	q.query.Query = fmt.Sprintf("SELECT %s FROM c%s%s", projection, filter, orderBy)
 	return nil
 }
+
+type projection struct {
+	name     string
+	key      string // set for the selected fields
+	children []*projection
+}
+
+// selectValue builds an object literal with the selected fields, keeping their nesting:
+// ["person.name", "state"] -> {"person": {"name": c.person.name}, "state": c.state}
+func selectValue(fields []string) (string, error) {
+	root := &projection{}
+	for _, key := range queries.SelectFields(fields) {
+		node := root
+		for _, name := range strings.Split(key, ".") {
+			var child *projection
+			for _, c := range node.children {
+				if c.name == name {
+					child = c
+					break
+				}
+			}
+			if child == nil {
+				child = &projection{name: name}
+				node.children = append(node.children, child)
+			}
+			node = child
+		}
+		node.key = key
+	}
+	return root.render()
+}
+
+func (p *projection) render() (string, error) {
+	if len(p.key) != 0 {
+		return fieldPath(p.key)
+	}
+	arr := make([]string, len(p.children))
+	for i, child := range p.children {
+		val, err := child.render()
+		if err != nil {
+			return "", err
+		}
+		// the name is validated by fieldPath of the leaf and needs no escaping
+		arr[i] = fmt.Sprintf(`"%s": %s`, child.name, val)
+	}
+	return "{" + strings.Join(arr, ", ") + "}", nil
+}
+
+// reserved keywords of the Cosmos SQL grammar that cannot be used as property names in dot notation
+var reservedWords = map[string]bool{
+	"AND": true, "ARRAY": true, "AS": true, "ASC": true, "BETWEEN": true, "BY": true,
+	"CASE": true, "CAST": true, "CONVERT": true, "CROSS": true, "DESC": true, "DISTINCT": true,
+	"ELSE": true, "END": true, "ESCAPE": true, "EXISTS": true, "FALSE": true, "FOR": true,
+	"FROM": true, "GROUP": true, "HAVING": true, "IN": true, "INNER": true, "INSERT": true,
+	"INTO": true, "IS": true, "JOIN": true, "LEFT": true, "LIKE": true, "LIMIT": true,
+	"NOT": true, "NULL": true, "OFFSET": true, "ON": true, "OR": true, "ORDER": true,
+	"OUTER": true, "OVER": true, "RIGHT": true, "SELECT": true, "SET": true, "THEN": true,
+	"TOP": true, "TRUE": true, "UDF": true, "UNDEFINED": true, "UPDATE": true, "VALUE": true,
+	"WHEN": true, "WHERE": true, "WITH": true,
+}
+
+// fieldPath converts a dotted key into a property reference of the document "c".
+// Plain identifiers use dot notation; other names (reserved words, hyphens, spaces)
+// are quoted with bracket notation. Keys containing characters that cannot be
+// safely quoted are rejected.
+func fieldPath(key string) (string, error) {
+	return propertyPath("c", key)
+}
+
+// propertyPath converts a dotted key into a property reference of the root alias
+func propertyPath(root, key string) (string, error) {
+	path := root
+	for _, field := range strings.Split(key, ".") {
+		if len(field) == 0 {
+			return "", fmt.Errorf("invalid key %q: empty field name", key)
+		}
+		for _, r := range field {
+			if r < 0x20 || r == 0x7f || strings.ContainsRune(`"'\[]`, r) {
+				return "", fmt.Errorf("invalid key %q: illegal character %q in field name", key, r)
+			}
+		}
+		if isIdentifier(field) && !reservedWords[strings.ToUpper(field)] {
+			path += "." + field
+		} else {
+			path += `["` + field + `"]`
+		}
+	}
+	return path, nil
+}
+
+func isIdentifier(str string) bool {
+	for i, r := range str {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
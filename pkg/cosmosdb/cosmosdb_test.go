@@ -1,9 +1,15 @@
 package cosmosdb
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/a8m/documentdb"
 	"github.com/dmitsh/docdb/pkg/queries"
@@ -78,6 +84,169 @@ func TestSqlQuery(t *testing.T) {
 				},
 			},
 		},
+		{
+			input: "../../tests/q5.json",
+			query: documentdb.Query{
+				Query: "SELECT * FROM c WHERE (NOT IS_DEFINED(c.state) OR c.state != @__param__0__) AND c.city >= @__param__1__ AND c.person.name < @__param__2__ ORDER BY c.city ASC",
+				Parameters: []documentdb.Parameter{
+					{
+						Name:  "@__param__0__",
+						Value: "CA",
+					},
+					{
+						Name:  "@__param__1__",
+						Value: "P",
+					},
+					{
+						Name:  "@__param__2__",
+						Value: "M",
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q6.json",
+			query: documentdb.Query{
+				Query: "SELECT * FROM c WHERE c.person.org > @__param__0__ OR c.state <= @__param__1__",
+				Parameters: []documentdb.Parameter{
+					{
+						Name:  "@__param__0__",
+						Value: "B",
+					},
+					{
+						Name:  "@__param__1__",
+						Value: "CA",
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q7.json",
+			query: documentdb.Query{
+				Query: "SELECT * FROM c WHERE NOT (c.person.org = @__param__0__ AND c.state = @__param__1__) ORDER BY c.person.name ASC",
+				Parameters: []documentdb.Parameter{
+					{
+						Name:  "@__param__0__",
+						Value: "A",
+					},
+					{
+						Name:  "@__param__1__",
+						Value: "WA",
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q8.json",
+			query: documentdb.Query{
+				Query:      "SELECT * FROM c WHERE c.person.code >= 1002 AND c.person.code < 1008.5 AND c.person.code IN (1003, 1005, 1007) AND (NOT IS_DEFINED(c.retired) OR c.retired != true) AND (NOT IS_DEFINED(c.state) OR c.state != null) ORDER BY c.person.code DESC",
+				Parameters: nil,
+			},
+		},
+		{
+			input: "../../tests/q9.json",
+			query: documentdb.Query{
+				Query: `SELECT VALUE {"person": {"name": c.person.name}, "state": c.state} FROM c WHERE c.person.org = @__param__0__ ORDER BY c.person.code DESC`,
+				Parameters: []documentdb.Parameter{
+					{
+						Name:  "@__param__0__",
+						Value: "A",
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q10.json",
+			query: documentdb.Query{
+				Query: "SELECT c.state AS state, COUNT(1) AS count, SUM(IS_NUMBER(c.person.code) ? c.person.code : 0) AS sum_person_code, MAX(c.person.name) AS last FROM c WHERE (NOT IS_DEFINED(c.person.org) OR c.person.org != @__param__0__) GROUP BY c.state",
+				Parameters: []documentdb.Parameter{
+					{
+						Name:  "@__param__0__",
+						Value: "C",
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q11.json",
+			query: documentdb.Query{
+				Query: "SELECT * FROM c WHERE STARTSWITH(c.person.name, @__param__0__, true) OR RegexMatch(c.city, @__param__1__) ORDER BY c.person.name ASC",
+				Parameters: []documentdb.Parameter{
+					{
+						Name:  "@__param__0__",
+						Value: "j",
+					},
+					{
+						Name:  "@__param__1__",
+						Value: "^San ",
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q12.json",
+			query: documentdb.Query{
+				Query: "SELECT * FROM c WHERE IS_DEFINED(c.person.code) AND NOT (IS_NULL(c.state)) AND NOT (IS_DEFINED(c.zip)) ORDER BY c.person.code DESC",
+			},
+		},
+		{
+			input: "../../tests/q13.json",
+			query: documentdb.Query{
+				Query: "SELECT * FROM c WHERE ARRAY_CONTAINS(c.tags, @__param__0__) OR " +
+					"EXISTS(SELECT VALUE t FROM t IN c.addresses WHERE t.city = @__param__1__ AND " +
+					"EXISTS(SELECT VALUE t1 FROM t1 IN t.phones WHERE STARTSWITH(t1.number, @__param__2__)))",
+				Parameters: []documentdb.Parameter{
+					{
+						Name:  "@__param__0__",
+						Value: "vip",
+					},
+					{
+						Name:  "@__param__1__",
+						Value: "Seattle",
+					},
+					{
+						Name:  "@__param__2__",
+						Value: "+1",
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q14.json",
+			query: documentdb.Query{
+				Query: "SELECT * FROM c WHERE (c.person.code >= 1003 AND c.person.code < 1006) OR c.person.name BETWEEN @__param__0__ AND @__param__1__ ORDER BY c.person.code ASC",
+				Parameters: []documentdb.Parameter{
+					{
+						Name:  "@__param__0__",
+						Value: "L",
+					},
+					{
+						Name:  "@__param__1__",
+						Value: "Mike",
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q15.json",
+			query: documentdb.Query{
+				Query: "SELECT * FROM c WHERE c.joined >= @__param__0__ AND (c.updated > @__param__1__ AND c.updated <= @__param__2__)",
+				Parameters: []documentdb.Parameter{
+					{
+						Name:  "@__param__0__",
+						Value: "2021-06-01T00:00:00.0000000Z",
+					},
+					{
+						Name:  "@__param__1__",
+						Value: "2021-01-01T00:00:00.0000000Z",
+					},
+					{
+						Name:  "@__param__2__",
+						Value: "2021-12-31T23:59:59.5000000Z",
+					},
+				},
+			},
+		},
 	}
 	for _, test := range tests {
 		data, err := os.ReadFile(test.input)
@@ -93,3 +262,325 @@ func TestSqlQuery(t *testing.T) {
 		assert.Equal(t, test.query, query.query)
 	}
 }
+
+func TestSqlFieldPath(t *testing.T) {
+	tests := []struct {
+		key  string
+		path string
+		err  string
+	}{
+		{
+			key:  "state",
+			path: "c.state",
+		},
+		{
+			key:  "person.name",
+			path: "c.person.name",
+		},
+		{
+			key:  "person.first-name",
+			path: `c.person["first-name"]`,
+		},
+		{
+			key:  "order.value",
+			path: `c["order"]["value"]`,
+		},
+		{
+			key:  "_ts",
+			path: "c._ts",
+		},
+		{
+			key:  "2fa",
+			path: `c["2fa"]`,
+		},
+		{
+			key:  "state = 1 OR 1=1 --",
+			path: `c["state = 1 OR 1=1 --"]`,
+		},
+		{
+			key: "state = 'x' OR 1=1 --",
+			err: `invalid key "state = 'x' OR 1=1 --": illegal character '\'' in field name`,
+		},
+		{
+			key: `state"] OR 1=1 --`,
+			err: `invalid key "state\"] OR 1=1 --": illegal character '"' in field name`,
+		},
+		{
+			key: "person\n.name",
+			err: `invalid key "person\n.name": illegal character '\n' in field name`,
+		},
+		{
+			key: "person..name",
+			err: `invalid key "person..name": empty field name`,
+		},
+		{
+			key: "",
+			err: `invalid key "": empty field name`,
+		},
+	}
+	for _, test := range tests {
+		path, err := fieldPath(test.key)
+		if len(test.err) != 0 {
+			assert.EqualError(t, err, test.err)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, test.path, path)
+		}
+	}
+
+	// hostile keys are rejected by the query builder as well
+	for _, mq := range []queries.MidQuery{
+		{Filter: &queries.FilterEQ{Key: "state = 'CA' OR 1=1 --", Val: "x"}},
+		{Filter: &queries.FilterIN{Key: "state'", Vals: []interface{}{"CA"}}},
+		{Sort: []queries.Sorting{{Key: "state; DROP", Order: queries.ASC}, {Key: "x'"}}},
+		{Filter: &queries.FilterANY{Key: "tags", Filter: &queries.FilterEQ{Key: "name'", Val: "x"}}},
+	} {
+		query := &Query{}
+		err := queries.NewQueryBuilder(query).BuildQuery(&mq)
+		assert.Error(t, err)
+	}
+}
+
+func TestSqlStringFunctions(t *testing.T) {
+	tests := []struct {
+		filter queries.Filter
+		query  string
+		value  string
+	}{
+		{
+			// the literals are passed as parameters, neither quoted nor regex-escaped
+			filter: &queries.FilterSTARTSWITH{Key: "city", Val: `St. Louis (MO) 'x'`},
+			query:  "SELECT * FROM c WHERE STARTSWITH(c.city, @__param__0__)",
+			value:  `St. Louis (MO) 'x'`,
+		},
+		{
+			filter: &queries.FilterCONTAINS{Key: "person.name", Val: "a+b*", IgnoreCase: true},
+			query:  "SELECT * FROM c WHERE CONTAINS(c.person.name, @__param__0__, true)",
+			value:  "a+b*",
+		},
+		{
+			filter: &queries.FilterEQ{Key: "state", Val: "ca", IgnoreCase: true},
+			query:  "SELECT * FROM c WHERE StringEquals(c.state, @__param__0__, true)",
+			value:  "ca",
+		},
+		{
+			filter: &queries.FilterREGEX{Key: "city", Pattern: `^san\s`, IgnoreCase: true},
+			query:  `SELECT * FROM c WHERE RegexMatch(c.city, @__param__0__, "i")`,
+			value:  `^san\s`,
+		},
+	}
+	for _, test := range tests {
+		query := &Query{}
+		err := queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{Filter: test.filter})
+		assert.NoError(t, err)
+		assert.Equal(t, test.query, query.query.Query)
+		assert.Equal(t, []documentdb.Parameter{{Name: "@__param__0__", Value: test.value}}, query.query.Parameters)
+	}
+}
+
+func TestPopulate(t *testing.T) {
+	type request struct {
+		pk  string
+		doc map[string]interface{}
+	}
+	reqs := []request{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var doc map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&doc))
+		assert.Equal(t, "true", r.Header.Get(documentdb.HeaderUpsert))
+		reqs = append(reqs, request{pk: r.Header.Get(documentdb.HeaderPartitionKey), doc: doc})
+		if doc["state"] == "XX" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code": "BadRequest", "message": "rejected"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(doc)
+	}))
+	defer srv.Close()
+
+	db := &DB{
+		pkPath: "/state",
+		client: documentdb.New(srv.URL, &documentdb.Config{
+			MasterKey: documentdb.NewKey("a2V5"),
+		}),
+		collection: &documentdb.Collection{Resource: documentdb.Resource{Self: "dbs/db1/colls/c1/"}},
+	}
+	data := []interface{}{
+		map[string]interface{}{"id": "1", "state": "WA", "joined": map[string]interface{}{"$date": "2021-06-01T02:00:00+02:00"}},
+		map[string]interface{}{"state": "CA"},
+		map[string]interface{}{"id": nil, "state": "OR"},
+		map[string]interface{}{"state": "XX"},
+		map[string]interface{}{"city": "Seattle"},
+		"not a document",
+	}
+	err := db.Populate(context.Background(), data)
+	assert.EqualError(t, err, "failed to upsert 3 of 6 documents: "+
+		"document 3: BadRequest, rejected; "+
+		"document 4: document has no partition key /state; "+
+		"document 5: unexpected document type string; expected JSON object")
+
+	assert.Len(t, reqs, 4)
+	assert.Equal(t, `["WA"]`, reqs[0].pk)
+	assert.Equal(t, "1", reqs[0].doc["id"])
+	assert.Equal(t, "2021-06-01T00:00:00.0000000Z", reqs[0].doc["joined"])
+	assert.Equal(t, `["CA"]`, reqs[1].pk)
+	assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", reqs[1].doc["id"])
+	// a null id is generated as well
+	assert.Equal(t, `["OR"]`, reqs[2].pk)
+	assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", reqs[2].doc["id"])
+	assert.NotEqual(t, reqs[1].doc["id"], reqs[2].doc["id"])
+	assert.Equal(t, `["XX"]`, reqs[3].pk)
+}
+
+func TestRunQueryTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	db := &DB{
+		timeouts: queries.Timeouts{Query: 50 * time.Millisecond},
+		client: documentdb.New(srv.URL, &documentdb.Config{
+			MasterKey: documentdb.NewKey("a2V5"),
+		}),
+		collection: &documentdb.Collection{Resource: documentdb.Resource{Self: "dbs/db1/colls/c1/"}},
+	}
+	query := &Query{}
+	assert.NoError(t, queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{}))
+	_, _, err := db.RunQuery(context.Background(), query, "")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+}
+
+func TestNumberLiterals(t *testing.T) {
+	tests := []struct {
+		val interface{}
+		lit string
+		err string
+	}{
+		{val: float64(-1.5), lit: "-1.5"},
+		{val: json.Number("1.5e3"), lit: "1.5e3"},
+		{val: math.Inf(1), err: "invalid number +Inf"},
+		{val: float32(math.NaN()), err: "invalid number NaN"},
+		{val: json.Number("Infinity"), err: `invalid number "Infinity"`},
+		{val: json.Number("0x1p-2"), err: `invalid number "0x1p-2"`},
+		{val: json.Number("1e400"), err: `invalid number "1e400"`},
+	}
+	for _, test := range tests {
+		lit, err := (&Query{}).setNextParamter(test.val)
+		if len(test.err) != 0 {
+			assert.EqualError(t, err, test.err)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, test.lit, lit)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	// the rows of a cross-partition GROUP BY come in two pages, with a partial row
+	// of the same group from every partition
+	pages := map[string]string{
+		"": `{"Documents": [{"state": "CA", "count": 2, "avg__sum": 2005, "avg__count": 2, "last": "Leo"}, ` +
+			`{"state": "OR", "count": 1, "avg__sum": 1004, "avg__count": 1, "last": "Ann"}, {"count": 1, "avg__sum": 0, "avg__count": 0, "last": null}], "_count": 3}`,
+		"2": `{"Documents": [{"state": "WA", "count": 3, "avg__sum": 3012, "avg__count": 3, "last": "Peter"}, ` +
+			`{"state": "CA", "count": 2, "avg__sum": 1002, "avg__count": 1, "last": "Nick"}, {"state": null, "count": 1, "avg__sum": 1001, "avg__count": 1, "last": "Kate"}], "_count": 3}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query documentdb.Query
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&query))
+		assert.Equal(t, "SELECT c.state AS state, COUNT(1) AS count, SUM(IS_NUMBER(c.code) ? c.code : 0) AS avg__sum, SUM(IS_NUMBER(c.code) ? 1 : 0) AS avg__count, MAX(c.name) AS last FROM c GROUP BY c.state", query.Query)
+		token := r.Header.Get(documentdb.HeaderContinuation)
+		if len(token) == 0 {
+			w.Header().Set(documentdb.HeaderContinuation, "2")
+		}
+		w.Write([]byte(pages[token]))
+	}))
+	defer srv.Close()
+
+	db := &DB{
+		client: documentdb.New(srv.URL, &documentdb.Config{
+			MasterKey: documentdb.NewKey("a2V5"),
+		}),
+		collection: &documentdb.Collection{Resource: documentdb.Resource{Self: "dbs/db1/colls/c1/"}},
+	}
+	query := &Query{}
+	err := queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Aggregate: &queries.Aggregation{
+			GroupBy: []string{"state"},
+			Functions: []queries.Aggregate{
+				{Op: queries.COUNT, As: "count"},
+				{Op: queries.AVG, Key: "code", As: "avg"},
+				{Op: queries.MAX, Key: "name", As: "last"},
+			},
+		},
+		Sort: []queries.Sorting{{Key: "count", Order: queries.DESC}, {Key: "state"}},
+		Page: queries.Pagination{Limit: 4},
+	})
+	assert.NoError(t, err)
+	ret, err := db.Aggregate(context.Background(), query)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"state": "CA", "count": float64(4), "avg": float64(1002.3333333333334), "last": "Nick"},
+		map[string]interface{}{"state": "WA", "count": float64(3), "avg": float64(1004), "last": "Peter"},
+		map[string]interface{}{"count": float64(1), "avg": nil, "last": nil},
+		map[string]interface{}{"state": nil, "count": float64(1), "avg": float64(1001), "last": "Kate"},
+	}, ret)
+
+	// the sort keys must be fields of the result rows, and aliases must not be keywords
+	err = queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Aggregate: &queries.Aggregation{Functions: []queries.Aggregate{{Op: queries.COUNT, As: "count"}}},
+		Sort:      []queries.Sorting{{Key: "state"}},
+	})
+	assert.EqualError(t, err, `sort key "state" is not a field of the aggregation`)
+	err = queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Aggregate: &queries.Aggregation{Functions: []queries.Aggregate{{Op: queries.COUNT, As: "value"}}},
+	})
+	assert.EqualError(t, err, `aggregate alias "value" is a reserved word`)
+	err = queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Aggregate: &queries.Aggregation{Functions: []queries.Aggregate{
+			{Op: queries.AVG, Key: "code", As: "avg"},
+			{Op: queries.SUM, Key: "code", As: "avg__sum"},
+		}},
+	})
+	assert.EqualError(t, err, `aggregate alias "avg__sum" is reserved for the average "avg"`)
+}
+
+func TestCount(t *testing.T) {
+	// partial counts of a cross-partition query are summed up
+	pages := map[string]string{
+		"":  `{"Documents": [2, 1], "_count": 2}`,
+		"2": `{"Documents": [1], "_count": 1}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query documentdb.Query
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&query))
+		assert.Equal(t, "SELECT VALUE COUNT(1) FROM c WHERE c.state = @__param__0__", query.Query)
+		assert.Equal(t, []documentdb.Parameter{{Name: "@__param__0__", Value: "CA"}}, query.Parameters)
+		token := r.Header.Get(documentdb.HeaderContinuation)
+		if len(token) == 0 {
+			w.Header().Set(documentdb.HeaderContinuation, "2")
+		}
+		w.Write([]byte(pages[token]))
+	}))
+	defer srv.Close()
+
+	db := &DB{
+		client: documentdb.New(srv.URL, &documentdb.Config{
+			MasterKey: documentdb.NewKey("a2V5"),
+		}),
+		collection: &documentdb.Collection{Resource: documentdb.Resource{Self: "dbs/db1/colls/c1/"}},
+	}
+	query := &Query{}
+	err := queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Filter: &queries.FilterEQ{Key: "state", Val: "CA"},
+		Sort:   []queries.Sorting{{Key: "city"}},
+		Page:   queries.Pagination{Limit: 2},
+	})
+	assert.NoError(t, err)
+	count, err := db.Count(context.Background(), query)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), count)
+}
@@ -0,0 +1,141 @@
+package memdb
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/dmitsh/docdb/pkg/queries"
+	"github.com/pkg/errors"
+)
+
+type group struct {
+	keys  []interface{}
+	found []bool // false for a missing group key
+	docs  []interface{}
+}
+
+// Aggregate groups the matching documents and computes the aggregate functions
+// the way Mongo does: a missing group key forms a group apart from null and is left
+// out of the result row, SUM and AVG ignore non-numeric values, and MIN and MAX
+// ignore null and missing values.
+func (db *DB) Aggregate(ctx context.Context, q interface{}) ([]interface{}, error) {
+	query, ok := q.(*Query)
+	if !ok {
+		return nil, errors.Errorf("Unexpected query type %s", reflect.TypeOf(q).String())
+	}
+	if query.aggregate == nil {
+		return nil, errors.New("query has no aggregation")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	agg := query.aggregate
+	for _, s := range query.sort {
+		if !contains(agg.Aliases(), s.Key) {
+			return nil, errors.Errorf("sort key %q is not a field of the aggregation", s.Key)
+		}
+	}
+
+	// groups in the order of their first document
+	groups := []*group{}
+	for _, doc := range db.snapshot() {
+		if query.match != nil && !query.match(doc) {
+			continue
+		}
+		keys := make([]interface{}, len(agg.GroupBy))
+		found := make([]bool, len(agg.GroupBy))
+		for i, key := range agg.GroupBy {
+			keys[i], found[i] = queries.LookupPath(doc, key)
+		}
+		var g *group
+		for _, other := range groups {
+			if sameKeys(other, keys, found) {
+				g = other
+				break
+			}
+		}
+		if g == nil {
+			g = &group{keys: keys, found: found}
+			groups = append(groups, g)
+		}
+		g.docs = append(g.docs, doc)
+	}
+
+	ret := make([]interface{}, len(groups))
+	for i, g := range groups {
+		row := map[string]interface{}{}
+		for j, key := range agg.GroupBy {
+			if g.found[j] {
+				row[queries.GroupAlias(key)] = g.keys[j]
+			}
+		}
+		for _, f := range agg.Functions {
+			row[f.As] = compute(f, g.docs)
+		}
+		ret[i] = row
+	}
+	queries.SortDocuments(ret, query.sort)
+	if query.limit > 0 && len(ret) > query.limit {
+		ret = ret[:query.limit]
+	}
+	return ret, nil
+}
+
+func compute(f queries.Aggregate, docs []interface{}) interface{} {
+	if f.Op == queries.COUNT {
+		return int64(len(docs))
+	}
+	var sum float64
+	var count int
+	var ret interface{}
+	for _, doc := range docs {
+		val, found := queries.LookupPath(doc, f.Key)
+		if !found || val == nil {
+			continue
+		}
+		switch f.Op {
+		case queries.SUM, queries.AVG:
+			if num, ok := queries.ToFloat(val); ok {
+				sum += num
+				count++
+			}
+		case queries.MIN:
+			if ret == nil || queries.CompareValues(val, ret) < 0 {
+				ret = val
+			}
+		case queries.MAX:
+			if ret == nil || queries.CompareValues(val, ret) > 0 {
+				ret = val
+			}
+		}
+	}
+	switch f.Op {
+	case queries.SUM:
+		return sum
+	case queries.AVG:
+		if count == 0 {
+			return nil
+		}
+		return sum / float64(count)
+	}
+	return ret
+}
+
+// sameKeys compares the group keys; numbers are compared by value
+func sameKeys(g *group, keys []interface{}, found []bool) bool {
+	for i := range keys {
+		if g.found[i] != found[i] || queries.CompareValues(g.keys[i], keys[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(arr []string, str string) bool {
+	for _, s := range arr {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
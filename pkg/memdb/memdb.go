@@ -0,0 +1,436 @@
+package memdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dmitsh/docdb/pkg/queries"
+	"github.com/pkg/errors"
+)
+
+// DB keeps the documents in memory. It is meant for running the CLI and
+// the unit tests without a database server.
+type DB struct {
+	mu   sync.RWMutex
+	docs []interface{}
+}
+
+type predicate func(doc interface{}) bool
+
+// Query is compiled from the MidQuery filter tree into a Go predicate
+type Query struct {
+	match  predicate
+	sort   []queries.Sorting
+	fields []string
+	limit  int
+
+	aggregate *queries.Aggregation
+}
+
+// GetDB creates an empty in-memory DB. If the config has a "data" entry,
+// the DB is preloaded with the documents from that JSON file.
+func GetDB(ctx context.Context, cfg map[string]string) (queries.DbInterface, error) {
+	db := &DB{}
+	if fname := cfg["data"]; len(fname) != 0 {
+		content, err := os.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		data := []interface{}{}
+		if err = json.Unmarshal(content, &data); err != nil {
+			return nil, err
+		}
+		if err = db.Populate(ctx, data); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func (db *DB) Disconnect(ctx context.Context) error {
+	return nil
+}
+
+// Populate adds the documents. Their time literals {"$date": "..."} are stored as
+// time.Time, like the BSON dates of Mongo.
+func (db *DB) Populate(ctx context.Context, data []interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	docs := make([]interface{}, len(data))
+	for i, doc := range data {
+		var err error
+		if docs[i], err = queries.ConvertDates(doc, func(t time.Time) interface{} { return t }); err != nil {
+			return errors.Wrapf(err, "document %d", i)
+		}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.docs = append(db.docs, docs...)
+	return nil
+}
+
+// RunQuery returns the matching documents. The token is the offset of the next page.
+func (db *DB) RunQuery(ctx context.Context, q interface{}, token string) ([]interface{}, string, error) {
+	query, ok := q.(*Query)
+	if !ok {
+		return nil, "", errors.Errorf("Unexpected query type %s", reflect.TypeOf(q).String())
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	var skip int
+	if len(token) != 0 {
+		var err error
+		if skip, err = strconv.Atoi(token); err != nil || skip < 0 {
+			return nil, "", errors.Errorf("invalid token %q", token)
+		}
+	}
+	ret := query.find(db.snapshot())
+	if skip >= len(ret) {
+		return []interface{}{}, "", nil
+	}
+	ret = ret[skip:]
+	token = ""
+	if query.limit > 0 && len(ret) > query.limit {
+		ret = ret[:query.limit]
+		token = strconv.Itoa(skip + query.limit)
+	}
+	if len(query.fields) != 0 {
+		projected := make([]interface{}, len(ret))
+		for i, doc := range ret {
+			projected[i] = project(doc, query.fields)
+		}
+		ret = projected
+	}
+	return ret, token, nil
+}
+
+// Count counts the documents matching the filter of the query
+func (db *DB) Count(ctx context.Context, q interface{}) (int64, error) {
+	query, ok := q.(*Query)
+	if !ok {
+		return 0, errors.Errorf("Unexpected query type %s", reflect.TypeOf(q).String())
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, doc := range db.snapshot() {
+		if query.match == nil || query.match(doc) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (db *DB) snapshot() []interface{} {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.docs[:len(db.docs):len(db.docs)]
+}
+
+// find returns the sorted list of matching documents
+func (query *Query) find(docs []interface{}) []interface{} {
+	ret := []interface{}{}
+	for _, doc := range docs {
+		if query.match == nil || query.match(doc) {
+			ret = append(ret, doc)
+		}
+	}
+	queries.SortDocuments(ret, query.sort)
+	return ret
+}
+
+// project copies the selected fields of the document, keeping their nesting
+func project(doc interface{}, fields []string) map[string]interface{} {
+	ret := map[string]interface{}{}
+	for _, key := range fields {
+		val, ok := queries.LookupPath(doc, key)
+		if !ok {
+			continue
+		}
+		names := strings.Split(key, ".")
+		node := ret
+		for _, name := range names[:len(names)-1] {
+			child, ok := node[name].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[name] = child
+			}
+			node = child
+		}
+		node[names[len(names)-1]] = val
+	}
+	return ret
+}
+
+// equal implements the EQ semantics: numbers are compared by value,
+// and null matches both null and missing fields
+func equal(val interface{}, found bool, v interface{}) bool {
+	if v == nil {
+		return !found || val == nil
+	}
+	if !found {
+		return false
+	}
+	if ret, ok := queries.CompareScalars(val, v); ok {
+		return ret == 0
+	}
+	return false
+}
+
+func (query *Query) VisitEQ(f *queries.FilterEQ) (interface{}, error) {
+	if str, ok := f.Val.(string); ok && f.IgnoreCase {
+		return query.visitString(f.Key, func(val string) bool {
+			return strings.EqualFold(val, str)
+		})
+	}
+	return predicate(func(doc interface{}) bool {
+		val, found := queries.LookupPath(doc, f.Key)
+		return equal(val, found, f.Val)
+	}), nil
+}
+
+func (query *Query) VisitNE(f *queries.FilterNE) (interface{}, error) {
+	// like $ne in Mongo, NE also matches documents without the field
+	return predicate(func(doc interface{}) bool {
+		val, found := queries.LookupPath(doc, f.Key)
+		return !equal(val, found, f.Val)
+	}), nil
+}
+
+func (query *Query) VisitGT(f *queries.FilterGT) (interface{}, error) {
+	return query.visitComparison(f.Key, f.Val, func(ret int) bool { return ret > 0 })
+}
+
+func (query *Query) VisitGTE(f *queries.FilterGTE) (interface{}, error) {
+	return query.visitComparison(f.Key, f.Val, func(ret int) bool { return ret >= 0 })
+}
+
+func (query *Query) VisitLT(f *queries.FilterLT) (interface{}, error) {
+	return query.visitComparison(f.Key, f.Val, func(ret int) bool { return ret < 0 })
+}
+
+func (query *Query) VisitLTE(f *queries.FilterLTE) (interface{}, error) {
+	return query.visitComparison(f.Key, f.Val, func(ret int) bool { return ret <= 0 })
+}
+
+// visitComparison matches the documents whose field is comparable with the value
+// (numbers with numbers, strings with strings) and satisfies the check
+func (query *Query) visitComparison(key string, v interface{}, check func(int) bool) (interface{}, error) {
+	return predicate(func(doc interface{}) bool {
+		val, found := queries.LookupPath(doc, key)
+		if !found {
+			return false
+		}
+		ret, ok := queries.CompareScalars(val, v)
+		return ok && check(ret)
+	}), nil
+}
+
+func (query *Query) VisitBETWEEN(f *queries.FilterBETWEEN) (interface{}, error) {
+	return predicate(func(doc interface{}) bool {
+		val, found := queries.LookupPath(doc, f.Key)
+		if !found {
+			return false
+		}
+		lower, ok := queries.CompareScalars(val, f.Lower)
+		if !ok || lower < 0 || (lower == 0 && !f.LowerInclusive) {
+			return false
+		}
+		upper, ok := queries.CompareScalars(val, f.Upper)
+		return ok && (upper < 0 || (upper == 0 && f.UpperInclusive))
+	}), nil
+}
+
+func (query *Query) VisitSTARTSWITH(f *queries.FilterSTARTSWITH) (interface{}, error) {
+	prefix := fold(f.Val, f.IgnoreCase)
+	return query.visitString(f.Key, func(val string) bool {
+		return strings.HasPrefix(fold(val, f.IgnoreCase), prefix)
+	})
+}
+
+func (query *Query) VisitCONTAINS(f *queries.FilterCONTAINS) (interface{}, error) {
+	substr := fold(f.Val, f.IgnoreCase)
+	return query.visitString(f.Key, func(val string) bool {
+		return strings.Contains(fold(val, f.IgnoreCase), substr)
+	})
+}
+
+func (query *Query) VisitREGEX(f *queries.FilterREGEX) (interface{}, error) {
+	pattern := f.Pattern
+	if f.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return query.visitString(f.Key, re.MatchString)
+}
+
+func (query *Query) VisitEXISTS(f *queries.FilterEXISTS) (interface{}, error) {
+	return predicate(func(doc interface{}) bool {
+		_, found := queries.LookupPath(doc, f.Key)
+		return found
+	}), nil
+}
+
+func (query *Query) VisitISNULL(f *queries.FilterISNULL) (interface{}, error) {
+	return predicate(func(doc interface{}) bool {
+		val, found := queries.LookupPath(doc, f.Key)
+		return found && val == nil
+	}), nil
+}
+
+func (query *Query) VisitARRAYCONTAINS(f *queries.FilterARRAYCONTAINS) (interface{}, error) {
+	return query.visitArray(f.Key, func(elem interface{}) bool {
+		return equal(elem, true, f.Val)
+	})
+}
+
+func (query *Query) VisitANY(f *queries.FilterANY) (interface{}, error) {
+	p, err := query.visitFilter(f.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return query.visitArray(f.Key, p)
+}
+
+// visitArray matches the documents whose field is an array with an element satisfying the check
+func (query *Query) visitArray(key string, check predicate) (interface{}, error) {
+	return predicate(func(doc interface{}) bool {
+		val, _ := queries.LookupPath(doc, key)
+		arr, ok := val.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, elem := range arr {
+			if check(elem) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// visitString matches the documents whose field is a string satisfying the check;
+// like in Mongo and Cosmos, the other types never match
+func (query *Query) visitString(key string, check func(string) bool) (interface{}, error) {
+	return predicate(func(doc interface{}) bool {
+		val, _ := queries.LookupPath(doc, key)
+		str, ok := val.(string)
+		return ok && check(str)
+	}), nil
+}
+
+func fold(str string, ignoreCase bool) string {
+	if ignoreCase {
+		return strings.ToLower(str)
+	}
+	return str
+}
+
+func (query *Query) VisitIN(f *queries.FilterIN) (interface{}, error) {
+	if len(f.Vals) == 0 {
+		return nil, fmt.Errorf("empty IN operator for key %q", f.Key)
+	}
+	return predicate(func(doc interface{}) bool {
+		val, found := queries.LookupPath(doc, f.Key)
+		for _, v := range f.Vals {
+			if equal(val, found, v) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (query *Query) visitFilters(filters []queries.Filter) ([]predicate, error) {
+	arr := make([]predicate, len(filters))
+	for i, filter := range filters {
+		p, err := query.visitFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = p
+	}
+	return arr, nil
+}
+
+func (query *Query) visitFilter(filter queries.Filter) (predicate, error) {
+	ret, err := queries.VisitFilter(query, filter)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := ret.(predicate)
+	if !ok {
+		return nil, fmt.Errorf("unexpected filter expression %#v", ret)
+	}
+	return p, nil
+}
+
+func (query *Query) VisitAND(f *queries.FilterAND) (interface{}, error) {
+	arr, err := query.visitFilters(f.Filters)
+	if err != nil {
+		return nil, err
+	}
+	return predicate(func(doc interface{}) bool {
+		for _, p := range arr {
+			if !p(doc) {
+				return false
+			}
+		}
+		return true
+	}), nil
+}
+
+func (query *Query) VisitOR(f *queries.FilterOR) (interface{}, error) {
+	arr, err := query.visitFilters(f.Filters)
+	if err != nil {
+		return nil, err
+	}
+	return predicate(func(doc interface{}) bool {
+		for _, p := range arr {
+			if p(doc) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (query *Query) VisitNOT(f *queries.FilterNOT) (interface{}, error) {
+	p, err := query.visitFilter(f.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return predicate(func(doc interface{}) bool {
+		return !p(doc)
+	}), nil
+}
+
+func (query *Query) Finalize(filters interface{}, mq *queries.MidQuery) error {
+	query.match = nil
+	if filters != nil {
+		p, ok := filters.(predicate)
+		if !ok {
+			return fmt.Errorf("unexpected filter expression %#v", filters)
+		}
+		query.match = p
+	}
+	query.sort = mq.Sort
+	query.aggregate = mq.Aggregate
+	query.fields = queries.SelectFields(mq.Select)
+	query.limit = mq.Page.Limit
+	return nil
+}
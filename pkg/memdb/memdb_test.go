@@ -0,0 +1,353 @@
+package memdb
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dmitsh/docdb/pkg/conformance"
+	"github.com/dmitsh/docdb/pkg/conformance/conformancetest"
+	"github.com/dmitsh/docdb/pkg/queries"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemQuery(t *testing.T) {
+	ctx := context.Background()
+	db, err := GetDB(ctx, map[string]string{"data": "../../tests/dataset.json"})
+	assert.NoError(t, err)
+	defer db.Disconnect(ctx)
+
+	tests := []struct {
+		input string
+		pages [][]string
+	}{
+		{
+			input: "../../tests/q1.json",
+			pages: [][]string{
+				{"Peter", "Kate"}, {"Nataly", "John"}, {"Nick", "Jeniffer"}, {"Mike", "Leo"}, {"Dave", "Ann"},
+			},
+		},
+		{
+			input: "../../tests/q2.json",
+			pages: [][]string{{"Nataly", "Nick"}, {"Mike", "Dave"}},
+		},
+		{
+			input: "../../tests/q3.json",
+			pages: [][]string{{"John", "Peter", "Mike"}},
+		},
+		{
+			input: "../../tests/q4.json",
+			pages: [][]string{{"John", "Leo"}, {"Peter", "Ann"}, {"Mike", "Nick"}},
+		},
+		{
+			input: "../../tests/q5.json",
+			pages: [][]string{{"Kate", "Leo", "John"}},
+		},
+		{
+			input: "../../tests/q6.json",
+			pages: [][]string{{"Nataly", "Nick", "Jeniffer"}, {"Mike", "Dave"}},
+		},
+		{
+			input: "../../tests/q7.json",
+			pages: [][]string{{"Ann", "Dave", "Jeniffer", "Kate", "Leo", "Mike", "Nataly", "Nick"}},
+		},
+		{
+			input: "../../tests/q8.json",
+			pages: [][]string{{"Mike", "Nick", "Nataly"}},
+		},
+		{
+			input: "../../tests/q9.json",
+			pages: [][]string{{"Ann", "Mike"}, {"John", "Peter"}},
+		},
+		{
+			input: "../../tests/q11.json",
+			pages: [][]string{{"Dave", "Jeniffer", "John", "Mike"}},
+		},
+		{
+			input: "../../tests/q12.json",
+			pages: [][]string{{"Mike", "Jeniffer", "Nick"}, {"John", "Nataly", "Kate"}, {"Peter"}},
+		},
+		{
+			input: "../../tests/q14.json",
+			pages: [][]string{{"Nataly", "John", "Nick", "Mike", "Leo"}},
+		},
+	}
+	for _, test := range tests {
+		data, err := os.ReadFile(test.input)
+		assert.NoError(t, err)
+		var mq queries.MidQuery
+		err = json.Unmarshal(data, &mq)
+		assert.NoError(t, err)
+
+		query := &Query{}
+		qbuilder := queries.NewQueryBuilder(query)
+		err = qbuilder.BuildQuery(&mq)
+		assert.NoError(t, err)
+
+		pages := [][]string{}
+		token := ""
+		for {
+			ret, next, err := db.RunQuery(ctx, query, token)
+			assert.NoError(t, err)
+			names := []string{}
+			for _, doc := range ret {
+				name, _ := queries.LookupPath(doc, "person.name")
+				names = append(names, name.(string))
+			}
+			pages = append(pages, names)
+			if len(next) == 0 {
+				break
+			}
+			token = next
+		}
+		assert.Equal(t, test.pages, pages, test.input)
+	}
+}
+
+func TestMemFilterSemantics(t *testing.T) {
+	ctx := context.Background()
+	db := &DB{}
+	db.Populate(ctx, []interface{}{
+		map[string]interface{}{"id": "1", "code": float64(1), "tag": "a"},
+		map[string]interface{}{"id": "2", "code": "1", "tag": nil},
+		map[string]interface{}{"id": "3", "code": true},
+		map[string]interface{}{"id": "4", "code": "St. Louis (MO)", "tag": "A"},
+	})
+	tests := []struct {
+		filter queries.Filter
+		ids    []string
+	}{
+		{filter: &queries.FilterEQ{Key: "code", Val: 1}, ids: []string{"1"}},
+		{filter: &queries.FilterEQ{Key: "code", Val: "1"}, ids: []string{"2"}},
+		{filter: &queries.FilterGTE{Key: "code", Val: 0}, ids: []string{"1"}},
+		{filter: &queries.FilterEQ{Key: "tag", Val: nil}, ids: []string{"2", "3"}},
+		{filter: &queries.FilterNE{Key: "tag", Val: "a"}, ids: []string{"2", "3", "4"}},
+		{filter: &queries.FilterIN{Key: "code", Vals: []interface{}{true, "1"}}, ids: []string{"2", "3"}},
+		{filter: &queries.FilterEQ{Key: "tag", Val: "a", IgnoreCase: true}, ids: []string{"1", "4"}},
+		{filter: &queries.FilterSTARTSWITH{Key: "code", Val: "1"}, ids: []string{"2"}},
+		{filter: &queries.FilterSTARTSWITH{Key: "code", Val: "St. "}, ids: []string{"4"}},
+		{filter: &queries.FilterSTARTSWITH{Key: "code", Val: "St.."}, ids: []string{}},
+		{filter: &queries.FilterCONTAINS{Key: "code", Val: "(mo)", IgnoreCase: true}, ids: []string{"4"}},
+		{filter: &queries.FilterCONTAINS{Key: "code", Val: "(mo)"}, ids: []string{}},
+		{filter: &queries.FilterBETWEEN{Key: "code", Lower: 0, Upper: 1, UpperInclusive: true}, ids: []string{"1"}},
+		{filter: &queries.FilterBETWEEN{Key: "code", Lower: 0, Upper: 1}, ids: []string{}},
+		{filter: &queries.FilterBETWEEN{Key: "code", Lower: "1", Upper: "T", LowerInclusive: true}, ids: []string{"2", "4"}},
+		{filter: &queries.FilterEXISTS{Key: "tag"}, ids: []string{"1", "2", "4"}},
+		{filter: &queries.FilterNOT{Filter: &queries.FilterEXISTS{Key: "tag"}}, ids: []string{"3"}},
+		{filter: &queries.FilterISNULL{Key: "tag"}, ids: []string{"2"}},
+		{filter: &queries.FilterNOT{Filter: &queries.FilterISNULL{Key: "tag"}}, ids: []string{"1", "3", "4"}},
+		{filter: &queries.FilterREGEX{Key: "code", Pattern: `^st\. louis`, IgnoreCase: true}, ids: []string{"4"}},
+	}
+	for _, test := range tests {
+		query := &Query{}
+		err := queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{Filter: test.filter})
+		assert.NoError(t, err)
+		ret, token, err := db.RunQuery(ctx, query, "")
+		assert.NoError(t, err)
+		assert.Empty(t, token)
+		ids := []string{}
+		for _, doc := range ret {
+			ids = append(ids, doc.(map[string]interface{})["id"].(string))
+		}
+		assert.Equal(t, test.ids, ids)
+	}
+}
+
+func TestMemArrays(t *testing.T) {
+	ctx := context.Background()
+	db := &DB{}
+	var data []interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`[
+		{"id": "1", "tags": ["vip", "new"], "addresses": [{"city": "Portland", "phones": [{"number": "+1 503"}]}]},
+		{"id": "2", "tags": "vip", "addresses": [{"city": "Seattle", "phones": [{"number": "+44 20"}]}, {"city": "Seattle", "phones": [{"number": "+1 206"}]}]},
+		{"id": "3", "tags": [], "addresses": {"city": "Seattle", "phones": [{"number": "+1 206"}]}},
+		{"id": "4", "tags": [1, null], "addresses": [{"city": "Seattle"}]}
+	]`), &data))
+	assert.NoError(t, db.Populate(ctx, data))
+
+	tests := []struct {
+		filter string
+		ids    []string
+	}{
+		// only arrays match, scalars do not
+		{filter: `{"ARRAY_CONTAINS": {"tags": "vip"}}`, ids: []string{"1"}},
+		{filter: `{"ARRAY_CONTAINS": {"tags": 1}}`, ids: []string{"4"}},
+		{filter: `{"ARRAY_CONTAINS": {"tags": null}}`, ids: []string{"4"}},
+		{filter: `{"ANY": {"addresses": {"EQ": {"city": "Seattle"}}}}`, ids: []string{"2", "4"}},
+		// the conditions apply to the same element
+		{filter: `{"ANY": {"addresses": {"AND": [{"EQ": {"city": "Seattle"}}, {"ANY": {"phones": {"STARTSWITH": {"number": "+1"}}}}]}}}`, ids: []string{"2"}},
+		{filter: `{"ELEMMATCH": {"addresses": {"NOT": {"EXISTS": "phones"}}}}`, ids: []string{"4"}},
+		{filter: `{"NOT": {"ANY": {"addresses": {"EQ": {"city": "Seattle"}}}}}`, ids: []string{"1", "3"}},
+	}
+	for _, test := range tests {
+		var mq queries.MidQuery
+		assert.NoError(t, json.Unmarshal([]byte(`{"filter": `+test.filter+`}`), &mq))
+		query := &Query{}
+		assert.NoError(t, queries.NewQueryBuilder(query).BuildQuery(&mq))
+		ret, _, err := db.RunQuery(ctx, query, "")
+		assert.NoError(t, err)
+		ids := []string{}
+		for _, doc := range ret {
+			ids = append(ids, doc.(map[string]interface{})["id"].(string))
+		}
+		assert.Equal(t, test.ids, ids, test.filter)
+	}
+}
+
+func TestMemDates(t *testing.T) {
+	ctx := context.Background()
+	db := &DB{}
+	db.Populate(ctx, []interface{}{
+		map[string]interface{}{"id": "1", "joined": "2021-06-01T02:00:00+02:00", "updated": "2021-03-01T00:00:00.0000000Z"},
+		map[string]interface{}{"id": "2", "joined": "2021-05-31T23:00:00-04:00", "updated": "2022-01-01T00:00:00Z"},
+		map[string]interface{}{"id": "3", "joined": "2021-05-31T23:59:59Z"},
+		map[string]interface{}{"id": "4", "joined": "yesterday"},
+		map[string]interface{}{"id": "5", "joined": time.Now().Add(-time.Hour).Format(time.RFC3339)},
+		// stored as time.Time
+		map[string]interface{}{"id": "6", "joined": map[string]interface{}{"$date": "2021-06-02T00:00:00Z"}},
+	})
+	q15, err := os.ReadFile("../../tests/q15.json")
+	assert.NoError(t, err)
+	tests := []struct {
+		query string
+		ids   []string
+	}{
+		// compared as points in time, whatever the timezone
+		{query: `{"filter": {"GTE": {"joined": {"$date": "2021-06-01"}}}}`, ids: []string{"1", "2", "5", "6"}},
+		// without a time literal, strings are compared as strings and never with time values
+		{query: `{"filter": {"GTE": {"joined": "2021-06-01"}}}`, ids: []string{"1", "4", "5"}},
+		{query: `{"filter": {"EQ": {"joined": {"$date": "2021-06-01T00:00:00Z"}}}}`, ids: []string{"1"}},
+		{query: `{"filter": {"LT": {"joined": {"$date": "2021-06-01"}}}}`, ids: []string{"3"}},
+		{query: `{"filter": {"GT": {"joined": {"$date": "now-1d"}}}}`, ids: []string{"5"}},
+		{query: string(q15), ids: []string{"1"}},
+	}
+	for _, test := range tests {
+		var mq queries.MidQuery
+		assert.NoError(t, json.Unmarshal([]byte(test.query), &mq))
+		query := &Query{}
+		assert.NoError(t, queries.NewQueryBuilder(query).BuildQuery(&mq))
+		ret, _, err := db.RunQuery(ctx, query, "")
+		assert.NoError(t, err)
+		ids := []string{}
+		for _, doc := range ret {
+			ids = append(ids, doc.(map[string]interface{})["id"].(string))
+		}
+		assert.Equal(t, test.ids, ids, test.query)
+	}
+}
+
+func TestMemConformance(t *testing.T) {
+	conformancetest.Run(t, "../../tests/dataset.json", conformance.Backend{
+		DB:         &DB{},
+		NewVisitor: func() queries.Visitor { return &Query{} },
+	})
+}
+
+func TestMemCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	db, err := GetDB(ctx, map[string]string{"data": "../../tests/dataset.json"})
+	assert.NoError(t, err)
+
+	query := &Query{}
+	assert.NoError(t, queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{}))
+	cancel()
+	_, _, err = db.RunQuery(ctx, query, "")
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, db.Populate(ctx, []interface{}{}))
+}
+
+func TestMemProjection(t *testing.T) {
+	ctx := context.Background()
+	db, err := GetDB(ctx, map[string]string{"data": "../../tests/dataset.json"})
+	assert.NoError(t, err)
+	query := &Query{}
+	err = queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Select: []string{"person.name", "state", "zip"},
+		Filter: &queries.FilterEQ{Key: "person.code", Val: 1005},
+	})
+	assert.NoError(t, err)
+	ret, _, err := db.RunQuery(ctx, query, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"person": map[string]interface{}{"name": "Nick"}, "state": "CA"},
+	}, ret)
+}
+
+func TestMemAggregate(t *testing.T) {
+	ctx := context.Background()
+	db, err := GetDB(ctx, map[string]string{"data": "../../tests/dataset.json"})
+	assert.NoError(t, err)
+	data, err := os.ReadFile("../../tests/q10.json")
+	assert.NoError(t, err)
+	var mq queries.MidQuery
+	assert.NoError(t, json.Unmarshal(data, &mq))
+	query := &Query{}
+	assert.NoError(t, queries.NewQueryBuilder(query).BuildQuery(&mq))
+
+	ret, err := db.Aggregate(ctx, query)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"state": "WA", "count": int64(3), "sum_person_code": float64(3013), "last": "Peter"},
+		map[string]interface{}{"state": "CA", "count": int64(2), "sum_person_code": float64(2012), "last": "Nick"},
+		map[string]interface{}{"state": "NY", "count": int64(1), "sum_person_code": float64(1010), "last": "Ann"},
+		map[string]interface{}{"state": "OR", "count": int64(1), "sum_person_code": float64(1002), "last": "Kate"},
+	}, ret)
+
+	// a single group without keys; AVG and MIN ignore missing values
+	assert.NoError(t, queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Filter: &queries.FilterEQ{Key: "person.org", Val: "A"},
+		Aggregate: &queries.Aggregation{Functions: []queries.Aggregate{
+			{Op: queries.AVG, Key: "person.code", As: "avg"},
+			{Op: queries.MIN, Key: "zip", As: "zip"},
+		}},
+	}))
+	ret, err = db.Aggregate(ctx, query)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{map[string]interface{}{"avg": float64(1005.5), "zip": "10001"}}, ret)
+
+	// a missing group key is a group of its own, apart from null
+	assert.NoError(t, queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Aggregate: &queries.Aggregation{
+			GroupBy:   []string{"rank"},
+			Functions: []queries.Aggregate{{Op: queries.COUNT, As: "count"}},
+		},
+	}))
+	ret, err = db.Aggregate(ctx, query)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"rank": float64(3), "count": int64(1)},
+		map[string]interface{}{"rank": nil, "count": int64(1)},
+		map[string]interface{}{"count": int64(6)},
+		map[string]interface{}{"rank": float64(1), "count": int64(1)},
+		map[string]interface{}{"rank": float64(2), "count": int64(1)},
+	}, ret)
+
+	_, err = db.Aggregate(ctx, &Query{})
+	assert.EqualError(t, err, "query has no aggregation")
+}
+
+func TestMemBuilder(t *testing.T) {
+	ctx := context.Background()
+	db, err := GetDB(ctx, map[string]string{"data": "../../tests/dataset.json"})
+	assert.NoError(t, err)
+	mq, err := queries.Where(queries.In("state", "CA", "WA")).
+		And(queries.In("person.org", "A", "B"), queries.Lt("person.code", 1008)).
+		OrderBy("state", queries.Desc).
+		OrderBy("person.code", queries.Desc).
+		Limit(10).
+		Build()
+	assert.NoError(t, err)
+	query := &Query{}
+	assert.NoError(t, queries.NewQueryBuilder(query).BuildQuery(mq))
+
+	ret, _, err := db.RunQuery(ctx, query, "")
+	assert.NoError(t, err)
+	names := []string{}
+	for _, doc := range ret {
+		name, _ := queries.LookupPath(doc, "person.name")
+		names = append(names, name.(string))
+	}
+	assert.Equal(t, []string{"John", "Peter", "Mike", "Nick"}, names)
+}
@@ -0,0 +1,117 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/dmitsh/docdb/pkg/queries"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var accumulators = map[string]string{
+	queries.SUM: "$sum",
+	queries.AVG: "$avg",
+	queries.MIN: "$min",
+	queries.MAX: "$max",
+}
+
+// Aggregate runs the aggregation pipeline and returns all result rows
+func (db *DB) Aggregate(ctx context.Context, q interface{}) ([]interface{}, error) {
+	query, ok := q.(*Query)
+	if !ok {
+		return nil, errors.Errorf("Unexpected query type %s", reflect.TypeOf(q).String())
+	}
+	if query.pipeline == nil {
+		return nil, errors.New("query has no aggregation")
+	}
+	ctx, cancel := queries.WithTimeout(ctx, db.timeouts.Query)
+	defer cancel()
+	cur, err := db.collection.Aggregate(ctx, query.pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	ret := []interface{}{}
+	for cur.Next(ctx) {
+		var result bson.M
+		if err := cur.Decode(&result); err != nil {
+			return nil, err
+		}
+		ret = append(ret, result)
+	}
+	return ret, cur.Err()
+}
+
+// pipeline translates the aggregation section into
+//
+//	[ { $match: <filter> }, { $group: ... }, { $project: ... }, { $sort: ... }, { $limit: n } ]
+//
+// The group keys are collected in "_id" and moved to their aliases by $project.
+func pipeline(filter bson.D, mq *queries.MidQuery) (mongo.Pipeline, error) {
+	agg := mq.Aggregate
+	ret := mongo.Pipeline{}
+	if len(filter) != 0 {
+		ret = append(ret, bson.D{{Key: "$match", Value: filter}})
+	}
+
+	var id interface{}
+	project := bson.D{{Key: "_id", Value: 0}}
+	if len(agg.GroupBy) != 0 {
+		keys := bson.D{}
+		for _, key := range agg.GroupBy {
+			if err := checkKey(key); err != nil {
+				return nil, err
+			}
+			alias := queries.GroupAlias(key)
+			keys = append(keys, bson.E{Key: alias, Value: "$" + key})
+			project = append(project, bson.E{Key: alias, Value: "$_id." + alias})
+		}
+		id = keys
+	}
+	group := bson.D{{Key: "_id", Value: id}}
+	for _, f := range agg.Functions {
+		var acc bson.D
+		if f.Op == queries.COUNT {
+			acc = bson.D{{Key: "$sum", Value: 1}}
+		} else {
+			if err := checkKey(f.Key); err != nil {
+				return nil, err
+			}
+			acc = bson.D{{Key: accumulators[f.Op], Value: "$" + f.Key}}
+		}
+		group = append(group, bson.E{Key: f.As, Value: acc})
+		project = append(project, bson.E{Key: f.As, Value: 1})
+	}
+	ret = append(ret, bson.D{{Key: "$group", Value: group}}, bson.D{{Key: "$project", Value: project}})
+
+	if len(mq.Sort) != 0 {
+		sort := bson.D{}
+		for _, s := range mq.Sort {
+			if !contains(agg.Aliases(), s.Key) {
+				return nil, fmt.Errorf("sort key %q is not a field of the aggregation", s.Key)
+			}
+			order := 1 // ascending
+			if s.Order == queries.DESC {
+				order = -1
+			}
+			sort = append(sort, bson.E{Key: s.Key, Value: order})
+		}
+		ret = append(ret, bson.D{{Key: "$sort", Value: sort}})
+	}
+	if mq.Page.Limit > 0 {
+		ret = append(ret, bson.D{{Key: "$limit", Value: int64(mq.Page.Limit)}})
+	}
+	return ret, nil
+}
+
+func contains(arr []string, str string) bool {
+	for _, s := range arr {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package mongodb
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Keyset pagination: instead of skipping the documents of the previous pages,
+// the next page starts right after the last returned document in the sort order.
+// The token is the canonical Extended JSON of the sort key values of that document
+// (including the "_id" tie-breaker), so the values keep their BSON types.
+//
+// Null and missing values sort before all others, which the seek filter takes
+// into account; otherwise the sort keys are expected to hold values of a single
+// BSON type, since Mongo range operators do not match across types.
+
+type keyset struct {
+	Values bson.A `bson:"v"`
+}
+
+func encodeToken(sort bson.D, doc bson.M) (string, error) {
+	ks := keyset{Values: make(bson.A, len(sort))}
+	for i, e := range sort {
+		ks.Values[i], _ = lookup(doc, e.Key)
+	}
+	data, err := bson.MarshalExtJSON(ks, true, false)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeToken(token string, size int) (bson.A, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.Errorf("invalid token %q", token)
+	}
+	var ks keyset
+	if err = bson.UnmarshalExtJSON(data, true, &ks); err != nil {
+		return nil, errors.Errorf("invalid token %q", token)
+	}
+	if len(ks.Values) != size {
+		return nil, errors.Errorf("invalid token %q: expected %d sort values, got %d", token, size, len(ks.Values))
+	}
+	return ks.Values, nil
+}
+
+// seekFilter matches the documents placed after the last one in the sort order:
+//
+//	{ $or: [ { k1: { $gt: v1 } }, { k1: v1, k2: { $gt: v2 } }, ... ] }
+//
+// with $lt for descending keys. In descending order the null (or missing) values
+// come after all others, so a non-null value of a descending key is followed by
+// { $or: [ { k: { $lt: v } }, { k: null } ] }.
+func seekFilter(sort bson.D, last bson.A) bson.D {
+	branches := bson.A{}
+	for i, e := range sort {
+		cond := bson.D{}
+		for j := 0; j < i; j++ {
+			cond = append(cond, bson.E{Key: sort[j].Key, Value: last[j]})
+		}
+		desc := e.Value == -1
+		switch {
+		case last[i] != nil && desc:
+			// {k: null} matches both null and missing values, which $lt never does
+			cond = append(cond, bson.E{Key: "$or", Value: bson.A{
+				bson.D{{Key: e.Key, Value: bson.D{{Key: "$lt", Value: last[i]}}}},
+				bson.D{{Key: e.Key, Value: nil}},
+			}})
+		case last[i] != nil:
+			cond = append(cond, bson.E{Key: e.Key, Value: bson.D{{Key: "$gt", Value: last[i]}}})
+		case desc:
+			// nothing sorts before null in descending order
+			continue
+		default:
+			// every value sorts after null (or missing) in ascending order
+			cond = append(cond, bson.E{Key: e.Key, Value: bson.D{{Key: "$ne", Value: nil}}})
+		}
+		branches = append(branches, cond)
+	}
+	if len(branches) == 1 {
+		return branches[0].(bson.D)
+	}
+	return bson.D{{Key: "$or", Value: branches}}
+}
+
+// lookup returns the value of the dotted key in the decoded document
+func lookup(doc interface{}, key string) (interface{}, bool) {
+	val := doc
+	for _, field := range strings.Split(key, ".") {
+		switch m := val.(type) {
+		case bson.M:
+			v, ok := m[field]
+			if !ok {
+				return nil, false
+			}
+			val = v
+		case map[string]interface{}:
+			v, ok := m[field]
+			if !ok {
+				return nil, false
+			}
+			val = v
+		case bson.D:
+			v, ok := m.Map()[field]
+			if !ok {
+				return nil, false
+			}
+			val = v
+		default:
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+func hasKey(doc bson.D, key string) bool {
+	for _, e := range doc {
+		if e.Key == key {
+			return true
+		}
+	}
+	return false
+}
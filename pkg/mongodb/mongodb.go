@@ -1,9 +1,12 @@
 package mongodb
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -11,6 +14,7 @@ import (
 	"github.com/dmitsh/docdb/pkg/queries"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -19,24 +23,26 @@ import (
 const ()
 
 type DB struct {
-	url    string
-	dbName string
-	cName  string
+	url      string
+	dbName   string
+	cName    string
+	timeouts queries.Timeouts
 
 	client     *mongo.Client
 	collection *mongo.Collection
-
-	ctx    context.Context
-	cancel context.CancelFunc
 }
 
 type Query struct {
-	query  string
-	filter interface{}
+	query  string // human-readable rendering of the filter
+	filter bson.D
+	sort   bson.D // sort order with the "_id" tie-breaker
+	fields []string
 	opts   *options.FindOptions
+
+	pipeline mongo.Pipeline // set when the query has an aggregation
 }
 
-func GetDB(cfg map[string]string) (queries.DbInterface, error) {
+func GetDB(ctx context.Context, cfg map[string]string) (queries.DbInterface, error) {
 	var err error
 
 	db := &DB{
@@ -44,14 +50,19 @@ func GetDB(cfg map[string]string) (queries.DbInterface, error) {
 		dbName: cfg["db"],
 		cName:  cfg["collection"],
 	}
+	if db.timeouts, err = queries.GetTimeouts(cfg); err != nil {
+		return nil, err
+	}
 
-	db.ctx, db.cancel = context.WithTimeout(context.Background(), 10*time.Second)
-	db.client, err = mongo.Connect(db.ctx, options.Client().ApplyURI(db.url))
+	ctx, cancel := queries.WithTimeout(ctx, db.timeouts.Connect)
+	defer cancel()
+
+	db.client, err = mongo.Connect(ctx, options.Client().ApplyURI(db.url))
 	if err != nil {
 		return nil, err
 	}
 
-	if err = db.client.Ping(db.ctx, readpref.Primary()); err != nil {
+	if err = db.client.Ping(ctx, readpref.Primary()); err != nil {
 		return nil, err
 	}
 
@@ -63,16 +74,20 @@ func GetDB(cfg map[string]string) (queries.DbInterface, error) {
 	return db, nil
 }
 
-func (db *DB) Disconnect() (err error) {
-	err = db.client.Disconnect(db.ctx)
-	db.cancel()
-	return
+func (db *DB) Disconnect(ctx context.Context) error {
+	return db.client.Disconnect(ctx)
 }
 
-func (db *DB) Populate(data []interface{}) error {
+// Populate inserts the documents. Their time literals {"$date": "..."} are stored
+// as BSON dates, which the filters with time literals compare with.
+func (db *DB) Populate(ctx context.Context, data []interface{}) error {
 	for _, dat := range data {
 		fmt.Printf("ADD %#v\n", dat)
-		res, err := db.collection.InsertOne(db.ctx, dat)
+		doc, err := queries.ConvertDates(dat, func(t time.Time) interface{} { return primitive.NewDateTimeFromTime(t) })
+		if err != nil {
+			return err
+		}
+		res, err := db.insert(ctx, doc)
 		if err != nil {
 			return err
 		}
@@ -81,27 +96,57 @@ func (db *DB) Populate(data []interface{}) error {
 	return nil
 }
 
-func (db *DB) RunQuery(q interface{}, token string) ([]interface{}, string, error) {
+func (db *DB) insert(ctx context.Context, doc interface{}) (*mongo.InsertOneResult, error) {
+	ctx, cancel := queries.WithTimeout(ctx, db.timeouts.Write)
+	defer cancel()
+	return db.collection.InsertOne(ctx, doc)
+}
+
+// RunQuery fetches the next page. The token holds the sort key values of the last
+// document of the previous page, which are used to resume right after it.
+func (db *DB) RunQuery(ctx context.Context, q interface{}, token string) ([]interface{}, string, error) {
 	query, ok := q.(*Query)
 	if !ok {
 		return nil, "", errors.Errorf("Unexpected query type %s", reflect.TypeOf(query).String())
 	}
 	//fmt.Printf("Query %#v\n", query.filter)
-	skip, err := query.setSkip(token)
-	if err != nil {
-		return nil, "", err
+	filter := query.filter
+	if len(token) != 0 {
+		last, err := decodeToken(token, len(query.sort))
+		if err != nil {
+			return nil, "", err
+		}
+		seek := seekFilter(query.sort, last)
+		if len(filter) == 0 {
+			filter = seek
+		} else {
+			filter = bson.D{{Key: "$and", Value: bson.A{filter, seek}}}
+		}
+	}
+	ctx, cancel := queries.WithTimeout(ctx, db.timeouts.Query)
+	defer cancel()
+	return db.query(ctx, query, filter)
+}
+
+// Count counts the documents matching the filter of the query
+func (db *DB) Count(ctx context.Context, q interface{}) (int64, error) {
+	query, ok := q.(*Query)
+	if !ok {
+		return 0, errors.Errorf("Unexpected query type %s", reflect.TypeOf(q).String())
 	}
-	return db.query(query, skip)
+	ctx, cancel := queries.WithTimeout(ctx, db.timeouts.Query)
+	defer cancel()
+	return db.collection.CountDocuments(ctx, query.filter)
 }
 
-func (db *DB) query(query *Query, skip int) ([]interface{}, string, error) {
-	cur, err := db.collection.Find(db.ctx, query.filter, []*options.FindOptions{query.opts}...)
+func (db *DB) query(ctx context.Context, query *Query, filter bson.D) ([]interface{}, string, error) {
+	cur, err := db.collection.Find(ctx, filter, []*options.FindOptions{query.opts}...)
 	if err != nil {
 		return nil, "", err
 	}
-	defer cur.Close(db.ctx)
+	defer cur.Close(ctx)
 	ret := []interface{}{}
-	for cur.Next(db.ctx) {
+	for cur.Next(ctx) {
 		var result bson.M
 		if err := cur.Decode(&result); err != nil {
 			return nil, "", err
@@ -112,112 +157,335 @@ func (db *DB) query(query *Query, skip int) ([]interface{}, string, error) {
 		return nil, "", err
 	}
 	var token string
-	if query.opts.Limit != nil && *query.opts.Limit != 0 {
-		token = strconv.Itoa(skip + len(ret))
+	if query.opts.Limit != nil && *query.opts.Limit != 0 && len(ret) == int(*query.opts.Limit) {
+		if token, err = encodeToken(query.sort, ret[len(ret)-1].(bson.M)); err != nil {
+			return nil, "", err
+		}
+	}
+	// drop the sort keys fetched only for the token
+	if len(query.fields) != 0 {
+		for i, doc := range ret {
+			ret[i] = project(doc.(bson.M), query.fields)
+		}
 	}
 	return ret, token, nil
 }
 
-func (query *Query) VisitEQ(f *queries.FilterEQ) (string, error) {
+func (query *Query) VisitEQ(f *queries.FilterEQ) (interface{}, error) {
 	// { <key>: <val> }
-	return fmt.Sprintf("{ %q: %q }", f.Key, f.Val), nil
+	if err := checkKey(f.Key); err != nil {
+		return nil, err
+	}
+	if str, ok := f.Val.(string); ok && f.IgnoreCase {
+		// { <key>: { $regex: "^<escaped val>$", $options: "i" } }
+		return query.visitRegex(f.Key, "^"+regexp.QuoteMeta(str)+"$", true)
+	}
+	return bson.D{{Key: f.Key, Value: bsonValue(f.Val)}}, nil
 }
 
-func (query *Query) VisitIN(f *queries.FilterIN) (string, error) {
-	// { $in: [ <val1>, <val2>, ... , <valN> ] }
+func (query *Query) VisitNE(f *queries.FilterNE) (interface{}, error) {
+	// { <key>: { $ne: <val> } }
+	return query.visitComparison("$ne", f.Key, f.Val)
+}
+
+func (query *Query) VisitGT(f *queries.FilterGT) (interface{}, error) {
+	// { <key>: { $gt: <val> } }
+	return query.visitComparison("$gt", f.Key, f.Val)
+}
+
+func (query *Query) VisitGTE(f *queries.FilterGTE) (interface{}, error) {
+	// { <key>: { $gte: <val> } }
+	return query.visitComparison("$gte", f.Key, f.Val)
+}
+
+func (query *Query) VisitLT(f *queries.FilterLT) (interface{}, error) {
+	// { <key>: { $lt: <val> } }
+	return query.visitComparison("$lt", f.Key, f.Val)
+}
+
+func (query *Query) VisitLTE(f *queries.FilterLTE) (interface{}, error) {
+	// { <key>: { $lte: <val> } }
+	return query.visitComparison("$lte", f.Key, f.Val)
+}
+
+func (query *Query) visitComparison(op, key string, val interface{}) (interface{}, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return bson.D{{Key: key, Value: bson.D{{Key: op, Value: bsonValue(val)}}}}, nil
+}
+
+func (query *Query) VisitIN(f *queries.FilterIN) (interface{}, error) {
+	// { <key>: { $in: [ <val1>, <val2>, ... , <valN> ] } }
 	if len(f.Vals) == 0 {
-		return "", fmt.Errorf("empty IN operator for key %q", f.Key)
+		return nil, fmt.Errorf("empty IN operator for key %q", f.Key)
+	}
+	if err := checkKey(f.Key); err != nil {
+		return nil, err
+	}
+	vals := make(bson.A, len(f.Vals))
+	for i, v := range f.Vals {
+		vals[i] = bsonValue(v)
+	}
+	return bson.D{{Key: f.Key, Value: bson.D{{Key: "$in", Value: vals}}}}, nil
+}
+
+func (query *Query) VisitSTARTSWITH(f *queries.FilterSTARTSWITH) (interface{}, error) {
+	// { <key>: { $regex: "^<escaped val>" } }
+	return query.visitRegex(f.Key, "^"+regexp.QuoteMeta(f.Val), f.IgnoreCase)
+}
+
+func (query *Query) VisitCONTAINS(f *queries.FilterCONTAINS) (interface{}, error) {
+	// { <key>: { $regex: "<escaped val>" } }
+	return query.visitRegex(f.Key, regexp.QuoteMeta(f.Val), f.IgnoreCase)
+}
+
+func (query *Query) VisitREGEX(f *queries.FilterREGEX) (interface{}, error) {
+	// { <key>: { $regex: "<pattern>" } }
+	return query.visitRegex(f.Key, f.Pattern, f.IgnoreCase)
+}
+
+func (query *Query) VisitEXISTS(f *queries.FilterEXISTS) (interface{}, error) {
+	// { <key>: { $exists: true } }
+	return query.visitComparison("$exists", f.Key, true)
+}
+
+func (query *Query) VisitISNULL(f *queries.FilterISNULL) (interface{}, error) {
+	// { <key>: { $type: "null" } }; unlike { <key>: null }, it does not match missing fields
+	return query.visitComparison("$type", f.Key, "null")
+}
+
+func (query *Query) VisitARRAYCONTAINS(f *queries.FilterARRAYCONTAINS) (interface{}, error) {
+	// { <key>: { $elemMatch: { $eq: <val> } } }; unlike { <key>: <val> }, it does not match scalars
+	return query.visitComparison("$elemMatch", f.Key, bson.D{{Key: "$eq", Value: bsonValue(f.Val)}})
+}
+
+func (query *Query) VisitANY(f *queries.FilterANY) (interface{}, error) {
+	// { <key>: { $elemMatch: { <expression> } } }
+	if err := checkKey(f.Key); err != nil {
+		return nil, err
 	}
-	str := fmt.Sprintf(`{ %q: { "$in": [ %q`, f.Key, f.Vals[0])
-	for _, v := range f.Vals[1:] {
-		str += fmt.Sprintf(", %q", v)
+	doc, err := queries.VisitFilter(query, f.Filter)
+	if err != nil {
+		return nil, err
 	}
-	str += " ] } }"
-	return str, nil
+	return bson.D{{Key: f.Key, Value: bson.D{{Key: "$elemMatch", Value: doc}}}}, nil
 }
 
-func (query *Query) visitFilters(op string, filters []queries.Filter) (string, error) {
-	arr := []string{}
+func (query *Query) visitRegex(key, pattern string, ignoreCase bool) (interface{}, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	regex := bson.D{{Key: "$regex", Value: pattern}}
+	if ignoreCase {
+		regex = append(regex, bson.E{Key: "$options", Value: "i"})
+	}
+	return bson.D{{Key: key, Value: regex}}, nil
+}
+
+func (query *Query) VisitBETWEEN(f *queries.FilterBETWEEN) (interface{}, error) {
+	// { <key>: { $gt(e): <lower>, $lt(e): <upper> } }
+	if err := checkKey(f.Key); err != nil {
+		return nil, err
+	}
+	lower, upper := "$gt", "$lt"
+	if f.LowerInclusive {
+		lower = "$gte"
+	}
+	if f.UpperInclusive {
+		upper = "$lte"
+	}
+	return bson.D{{Key: f.Key, Value: bson.D{
+		{Key: lower, Value: bsonValue(f.Lower)},
+		{Key: upper, Value: bsonValue(f.Upper)},
+	}}}, nil
+}
+
+func (query *Query) visitFilters(op string, filters []queries.Filter) (interface{}, error) {
+	arr := bson.A{}
 	for _, filter := range filters {
-		switch f := filter.(type) {
-		case *queries.FilterEQ:
-			if str, err := query.VisitEQ(f); err != nil {
-				return "", err
-			} else {
-				arr = append(arr, str)
-			}
-		case *queries.FilterIN:
-			if str, err := query.VisitIN(f); err != nil {
-				return "", err
-			} else {
-				arr = append(arr, str)
-			}
-		case *queries.FilterOR:
-			if str, err := query.VisitOR(f); err != nil {
-				return "", err
-			} else {
-				arr = append(arr, str)
-			}
-		case *queries.FilterAND:
-			if str, err := query.VisitAND(f); err != nil {
-				return "", err
-			} else {
-				arr = append(arr, str)
-			}
-		default:
-			return "", fmt.Errorf("Unsupported filter type %#v", f)
+		doc, err := queries.VisitFilter(query, filter)
+		if err != nil {
+			return nil, err
 		}
+		arr = append(arr, doc)
 	}
-	return fmt.Sprintf(`{ "%s": [ %s ] }`, op, strings.Join(arr, ", ")), nil
+	return bson.D{{Key: op, Value: arr}}, nil
 }
 
-func (query *Query) VisitAND(f *queries.FilterAND) (string, error) {
+func (query *Query) VisitAND(f *queries.FilterAND) (interface{}, error) {
 	// { $and: [ { <expression1> }, { <expression2> } , ... , { <expressionN> } ] }
 	return query.visitFilters("$and", f.Filters)
 }
 
-func (query *Query) VisitOR(f *queries.FilterOR) (string, error) {
+func (query *Query) VisitOR(f *queries.FilterOR) (interface{}, error) {
 	// { $or: [ { <expression1> }, { <expression2> } , ... , { <expressionN> } ] }
 	return query.visitFilters("$or", f.Filters)
 }
 
-func (query *Query) Finalize(filters string, mq *queries.MidQuery) error {
-	query.query = filters
-	if len(filters) == 0 {
+func (query *Query) VisitNOT(f *queries.FilterNOT) (interface{}, error) {
+	// { $nor: [ { <expression> } ] }
+	return query.visitFilters("$nor", []queries.Filter{f.Filter})
+}
+
+func (query *Query) Finalize(filters interface{}, mq *queries.MidQuery) error {
+	if filters == nil {
 		query.filter = bson.D{}
-	} else if err := bson.UnmarshalExtJSON([]byte(filters), false, &query.filter); err != nil {
-		return err
+		query.query = ""
+	} else {
+		filter, ok := filters.(bson.D)
+		if !ok {
+			return fmt.Errorf("unexpected filter expression %#v", filters)
+		}
+		query.filter = filter
+		query.query = render(filter)
 	}
+	// reset the state of a previous query, as the aggregation does not set it
 	query.opts = options.Find()
+	query.pipeline = nil
+	query.sort = bson.D{}
+	query.fields = nil
+	if mq.Aggregate != nil {
+		var err error
+		query.pipeline, err = pipeline(query.filter, mq)
+		return err
+	}
 
-	// sorting
-	if len(mq.Sort) > 0 {
-		sort := bson.D{}
-		for _, s := range mq.Sort {
-			order := 1 // ascending
-			if s.Order == queries.DESC {
-				order = -1
+	// sorting; "_id" makes the order total, as required by keyset pagination
+	for _, s := range mq.Sort {
+		if err := checkKey(s.Key); err != nil {
+			return err
+		}
+		order := 1 // ascending
+		if s.Order == queries.DESC {
+			order = -1
+		}
+		query.sort = append(query.sort, bson.E{Key: s.Key, Value: order})
+	}
+	// The tie-breaker goes to query.sort, not to mq.Sort: "_id" is specific to Mongo,
+	// and the token fingerprint is computed from mq.Sort by the backend-neutral codec.
+	// As "_id" is always appended, the fingerprint still identifies the order, while
+	// the token values (encodeToken) and seekFilter both follow query.sort.
+	if !hasKey(query.sort, "_id") {
+		query.sort = append(query.sort, bson.E{Key: "_id", Value: 1})
+	}
+	query.opts.SetSort(query.sort)
+	// projection; the sort keys are needed for the pagination token
+	if len(mq.Select) != 0 {
+		query.fields = queries.SelectFields(mq.Select)
+		fields := append([]string{}, query.fields...)
+		for _, e := range query.sort {
+			fields = append(fields, e.Key)
+		}
+		projection := bson.D{}
+		for _, field := range queries.SelectFields(fields) {
+			if err := checkKey(field); err != nil {
+				return err
 			}
-			sort = append(sort, bson.E{Key: s.Key, Value: order})
+			projection = append(projection, bson.E{Key: field, Value: 1})
 		}
-		query.opts.SetSort(sort)
+		query.opts.SetProjection(projection)
 	}
 	// pagination
 	if mq.Page.Limit > 0 {
 		query.opts.SetLimit(int64(mq.Page.Limit))
 	}
-	if _, err := query.setSkip(mq.Page.Token); err != nil {
-		return err
+	return nil
+}
+
+// project copies the selected fields of the document, keeping their nesting
+func project(doc bson.M, fields []string) bson.M {
+	ret := bson.M{}
+	for _, key := range fields {
+		val, ok := lookup(doc, key)
+		if !ok {
+			continue
+		}
+		names := strings.Split(key, ".")
+		node := ret
+		for _, name := range names[:len(names)-1] {
+			child, ok := node[name].(bson.M)
+			if !ok {
+				child = bson.M{}
+				node[name] = child
+			}
+			node = child
+		}
+		node[names[len(names)-1]] = val
+	}
+	return ret
+}
+
+// checkKey rejects field paths that Mongo would interpret as operators
+func checkKey(key string) error {
+	for _, field := range strings.Split(key, ".") {
+		if len(field) == 0 {
+			return fmt.Errorf("invalid key %q: empty field name", key)
+		}
+		if strings.HasPrefix(field, "$") {
+			return fmt.Errorf("invalid key %q: field name must not start with '$'", key)
+		}
+		if strings.ContainsRune(field, 0) {
+			return fmt.Errorf("invalid key %q: field name must not contain null character", key)
+		}
 	}
 	return nil
 }
 
-func (query *Query) setSkip(token string) (skip int, err error) {
-	if len(token) != 0 {
-		if skip, err = strconv.Atoi(token); err != nil {
-			return
+// bsonValue converts the filter value into its native BSON counterpart
+func bsonValue(v interface{}) interface{} {
+	if d, ok := v.(queries.Date); ok {
+		return primitive.NewDateTimeFromTime(d.Time)
+	}
+	if num, ok := v.(json.Number); ok {
+		if i, err := num.Int64(); err == nil {
+			return i
+		}
+		if f, err := num.Float64(); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// render formats the filter document as relaxed Extended JSON for logging and tests
+func render(v interface{}) string {
+	switch val := v.(type) {
+	case bson.D:
+		arr := make([]string, len(val))
+		for i, e := range val {
+			arr[i] = fmt.Sprintf("%s: %s", quote(e.Key), render(e.Value))
+		}
+		return "{ " + strings.Join(arr, ", ") + " }"
+	case bson.A:
+		arr := make([]string, len(val))
+		for i, e := range val {
+			arr[i] = render(e)
 		}
-		query.opts.SetSkip(int64(skip))
+		return "[ " + strings.Join(arr, ", ") + " ]"
+	case nil:
+		return "null"
+	case string:
+		return quote(val)
+	case bool:
+		return strconv.FormatBool(val)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(val), 'f', -1, 32)
+	case primitive.DateTime:
+		return fmt.Sprintf("{ \"$date\": %s }", quote(val.Time().UTC().Format(time.RFC3339Nano)))
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+func quote(str string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(str); err != nil {
+		return strconv.Quote(str)
 	}
-	return
+	return strings.TrimSuffix(buf.String(), "\n")
 }
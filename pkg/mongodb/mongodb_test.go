@@ -1,12 +1,21 @@
 package mongodb
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/dmitsh/docdb/pkg/conformance"
+	"github.com/dmitsh/docdb/pkg/conformance/conformancetest"
 	"github.com/dmitsh/docdb/pkg/queries"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func TestMongoQuery(t *testing.T) {
@@ -30,6 +39,50 @@ func TestMongoQuery(t *testing.T) {
 			input: "../../tests/q4.json",
 			query: `{ "$or": [ { "person.org": "A" }, { "$and": [ { "person.org": "B" }, { "state": { "$in": [ "CA", "WA" ] } } ] } ] }`,
 		},
+		{
+			input: "../../tests/q5.json",
+			query: `{ "$and": [ { "state": { "$ne": "CA" } }, { "city": { "$gte": "P" } }, { "person.name": { "$lt": "M" } } ] }`,
+		},
+		{
+			input: "../../tests/q6.json",
+			query: `{ "$or": [ { "person.org": { "$gt": "B" } }, { "state": { "$lte": "CA" } } ] }`,
+		},
+		{
+			input: "../../tests/q7.json",
+			query: `{ "$nor": [ { "$and": [ { "person.org": "A" }, { "state": "WA" } ] } ] }`,
+		},
+		{
+			input: "../../tests/q8.json",
+			query: `{ "$and": [ { "person.code": { "$gte": 1002 } }, { "person.code": { "$lt": 1008.5 } }, { "person.code": { "$in": [ 1003, 1005, 1007 ] } }, { "retired": { "$ne": true } }, { "state": { "$ne": null } } ] }`,
+		},
+		{
+			input: "../../tests/q9.json",
+			query: `{ "person.org": "A" }`,
+		},
+		{
+			input: "../../tests/q10.json",
+			query: `{ "person.org": { "$ne": "C" } }`,
+		},
+		{
+			input: "../../tests/q11.json",
+			query: `{ "$or": [ { "person.name": { "$regex": "^j", "$options": "i" } }, { "city": { "$regex": "^San " } } ] }`,
+		},
+		{
+			input: "../../tests/q12.json",
+			query: `{ "$and": [ { "person.code": { "$exists": true } }, { "$nor": [ { "state": { "$type": "null" } } ] }, { "$nor": [ { "zip": { "$exists": true } } ] } ] }`,
+		},
+		{
+			input: "../../tests/q13.json",
+			query: `{ "$or": [ { "tags": { "$elemMatch": { "$eq": "vip" } } }, { "addresses": { "$elemMatch": { "$and": [ { "city": "Seattle" }, { "phones": { "$elemMatch": { "number": { "$regex": "^\\+1" } } } } ] } } } ] }`,
+		},
+		{
+			input: "../../tests/q14.json",
+			query: `{ "$or": [ { "person.code": { "$gte": 1003, "$lt": 1006 } }, { "person.name": { "$gte": "L", "$lte": "Mike" } } ] }`,
+		},
+		{
+			input: "../../tests/q15.json",
+			query: `{ "$and": [ { "joined": { "$gte": { "$date": "2021-06-01T00:00:00Z" } } }, { "updated": { "$gt": { "$date": "2021-01-01T00:00:00Z" }, "$lte": { "$date": "2021-12-31T23:59:59.5Z" } } } ] }`,
+		},
 	}
 	for _, test := range tests {
 		data, err := os.ReadFile(test.input)
@@ -45,3 +98,225 @@ func TestMongoQuery(t *testing.T) {
 		assert.Equal(t, test.query, query.query)
 	}
 }
+
+func TestMongoFilter(t *testing.T) {
+	tests := []struct {
+		filter queries.Filter
+		query  string
+		bson   bson.D
+		err    string
+	}{
+		{
+			filter: &queries.FilterEQ{Key: "person.name", Val: `O"Brien`},
+			query:  `{ "person.name": "O\"Brien" }`,
+			bson:   bson.D{{Key: "person.name", Value: `O"Brien`}},
+		},
+		{
+			filter: &queries.FilterEQ{Key: "state", Val: "$where"},
+			query:  `{ "state": "$where" }`,
+			bson:   bson.D{{Key: "state", Value: "$where"}},
+		},
+		{
+			filter: &queries.FilterIN{Key: "person.code", Vals: []interface{}{json.Number("1001"), 1002.5, true, nil}},
+			query:  `{ "person.code": { "$in": [ 1001, 1002.5, true, null ] } }`,
+			bson:   bson.D{{Key: "person.code", Value: bson.D{{Key: "$in", Value: bson.A{int64(1001), 1002.5, true, nil}}}}},
+		},
+		{
+			filter: &queries.FilterLT{Key: "joined", Val: queries.Date{Time: time.Date(2021, 6, 1, 2, 0, 0, 0, time.FixedZone("CEST", 2*3600))}},
+			query:  `{ "joined": { "$lt": { "$date": "2021-06-01T00:00:00Z" } } }`,
+			bson:   bson.D{{Key: "joined", Value: bson.D{{Key: "$lt", Value: primitive.NewDateTimeFromTime(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC))}}}},
+		},
+		{
+			// regex metacharacters of the literals are escaped
+			filter: &queries.FilterSTARTSWITH{Key: "city", Val: "St. Louis (MO)"},
+			query:  `{ "city": { "$regex": "^St\\. Louis \\(MO\\)" } }`,
+			bson:   bson.D{{Key: "city", Value: bson.D{{Key: "$regex", Value: `^St\. Louis \(MO\)`}}}},
+		},
+		{
+			filter: &queries.FilterCONTAINS{Key: "person.name", Val: `a+b*c?[d]{e}|f^$\`, IgnoreCase: true},
+			bson: bson.D{{Key: "person.name", Value: bson.D{
+				{Key: "$regex", Value: `a\+b\*c\?\[d\]\{e\}\|f\^\$\\`},
+				{Key: "$options", Value: "i"},
+			}}},
+		},
+		{
+			filter: &queries.FilterEQ{Key: "state", Val: "c.a", IgnoreCase: true},
+			query:  `{ "state": { "$regex": "^c\\.a$", "$options": "i" } }`,
+		},
+		{
+			filter: &queries.FilterREGEX{Key: "city", Pattern: "^(San|Los) "},
+			query:  `{ "city": { "$regex": "^(San|Los) " } }`,
+		},
+		{
+			filter: &queries.FilterANY{Key: "tags", Filter: &queries.FilterEQ{Key: "$where", Val: "1"}},
+			err:    `invalid key "$where": field name must not start with '$'`,
+		},
+		{
+			filter: &queries.FilterEQ{Key: "$where", Val: "1 == 1"},
+			err:    `invalid key "$where": field name must not start with '$'`,
+		},
+		{
+			filter: &queries.FilterGT{Key: "person..code", Val: 1},
+			err:    `invalid key "person..code": empty field name`,
+		},
+	}
+	for _, test := range tests {
+		query := &Query{}
+		qbuilder := queries.NewQueryBuilder(query)
+		err := qbuilder.BuildQuery(&queries.MidQuery{Filter: test.filter})
+		if len(test.err) != 0 {
+			assert.EqualError(t, err, test.err)
+			continue
+		}
+		assert.NoError(t, err)
+		if len(test.query) != 0 {
+			assert.Equal(t, test.query, query.query)
+		}
+		if test.bson != nil {
+			assert.Equal(t, test.bson, query.filter)
+		}
+	}
+}
+
+// TestMongoConformance runs the conformance suite against a local MongoDB,
+// e.g. started with scripts/run-all.sh, when MONGODB_URL is set
+func TestMongoConformance(t *testing.T) {
+	url := os.Getenv("MONGODB_URL")
+	if len(url) == 0 {
+		t.Skip("MONGODB_URL is not set")
+	}
+	ctx := context.Background()
+	db, err := GetDB(ctx, map[string]string{
+		"url":        url,
+		"db":         "conformance",
+		"collection": fmt.Sprintf("c%d", time.Now().UnixNano()),
+	})
+	require.NoError(t, err)
+	defer func() {
+		mdb := db.(*DB)
+		assert.NoError(t, mdb.collection.Drop(ctx))
+		assert.NoError(t, db.Disconnect(ctx))
+	}()
+
+	conformancetest.Run(t, "../../tests/dataset.json", conformance.Backend{
+		DB:         db,
+		NewVisitor: func() queries.Visitor { return &Query{} },
+	})
+}
+
+func TestMongoKeyset(t *testing.T) {
+	data, err := os.ReadFile("../../tests/q4.json")
+	require.NoError(t, err)
+	var mq queries.MidQuery
+	require.NoError(t, json.Unmarshal(data, &mq))
+	query := &Query{}
+	require.NoError(t, queries.NewQueryBuilder(query).BuildQuery(&mq))
+
+	// "_id" is appended as a tie-breaker
+	sort := bson.D{{Key: "state", Value: -1}, {Key: "person.name", Value: 1}, {Key: "_id", Value: 1}}
+	assert.Equal(t, sort, query.sort)
+	assert.Equal(t, sort, query.opts.Sort)
+	assert.Len(t, mq.Sort, 2)
+
+	id, err := primitive.ObjectIDFromHex("611e9a07b0f8a4d9d0b1c001")
+	require.NoError(t, err)
+	last := bson.M{"_id": id, "state": "WA", "person": bson.M{"name": "Leo", "code": int32(1008)}}
+	token, err := encodeToken(query.sort, last)
+	require.NoError(t, err)
+
+	vals, err := decodeToken(token, len(query.sort))
+	require.NoError(t, err)
+	assert.Equal(t, bson.A{"WA", "Leo", id}, vals)
+
+	assert.Equal(t, `{ "$or": [ { "$or": [ { "state": { "$lt": "WA" } }, { "state": null } ] }, { "state": "WA", "person.name": { "$gt": "Leo" } }, `+
+		`{ "state": "WA", "person.name": "Leo", "_id": { "$gt": ObjectID("611e9a07b0f8a4d9d0b1c001") } } ] }`,
+		render(seekFilter(query.sort, vals)))
+
+	// missing sort values
+	sort = bson.D{{Key: "city", Value: 1}, {Key: "state", Value: -1}, {Key: "_id", Value: 1}}
+	token, err = encodeToken(sort, bson.M{"_id": id})
+	require.NoError(t, err)
+	vals, err = decodeToken(token, len(sort))
+	require.NoError(t, err)
+	assert.Equal(t, bson.A{nil, nil, id}, vals)
+	assert.Equal(t, `{ "$or": [ { "city": { "$ne": null } }, `+
+		`{ "city": null, "state": null, "_id": { "$gt": ObjectID("611e9a07b0f8a4d9d0b1c001") } } ] }`,
+		render(seekFilter(sort, vals)))
+
+	_, err = decodeToken(token, 2)
+	assert.Error(t, err)
+	_, err = decodeToken("2", 3)
+	assert.Error(t, err)
+}
+
+func TestMongoProjection(t *testing.T) {
+	query := &Query{}
+	err := queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Select: []string{"person.name", "state", "person"},
+		Sort:   []queries.Sorting{{Key: "city"}, {Key: "person.code"}},
+	})
+	require.NoError(t, err)
+	// the sort keys and "_id" are fetched for the pagination token
+	assert.Equal(t, bson.D{{Key: "state", Value: 1}, {Key: "person", Value: 1}, {Key: "city", Value: 1}, {Key: "_id", Value: 1}}, query.opts.Projection)
+	assert.Equal(t, []string{"state", "person"}, query.fields)
+
+	doc := bson.M{"_id": "x", "city": "Seattle", "state": "WA", "person": bson.M{"name": "Peter", "code": 1001}}
+	assert.Equal(t, bson.M{"state": "WA", "person": bson.M{"name": "Peter", "code": 1001}}, project(doc, query.fields))
+	assert.Equal(t, bson.M{"person": bson.M{"name": "Peter"}}, project(doc, []string{"person.name", "person.org"}))
+}
+
+func TestMongoAggregate(t *testing.T) {
+	data, err := os.ReadFile("../../tests/q10.json")
+	require.NoError(t, err)
+	var mq queries.MidQuery
+	require.NoError(t, json.Unmarshal(data, &mq))
+	mq.Page.Limit = 2
+	// the visitor is reused after a find query with sort and projection
+	query := &Query{}
+	require.NoError(t, queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Sort:   []queries.Sorting{{Key: "state", Order: queries.DESC}},
+		Select: []string{"state"},
+	}))
+	require.NoError(t, queries.NewQueryBuilder(query).BuildQuery(&mq))
+	assert.Equal(t, bson.D{}, query.sort)
+	assert.Nil(t, query.fields)
+	assert.Equal(t, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "person.org", Value: bson.D{{Key: "$ne", Value: "C"}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "state", Value: "$state"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "sum_person_code", Value: bson.D{{Key: "$sum", Value: "$person.code"}}},
+			{Key: "last", Value: bson.D{{Key: "$max", Value: "$person.name"}}},
+		}}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "state", Value: "$_id.state"},
+			{Key: "count", Value: 1},
+			{Key: "sum_person_code", Value: 1},
+			{Key: "last", Value: 1},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "state", Value: 1}}}},
+		{{Key: "$limit", Value: int64(2)}},
+	}, query.pipeline)
+
+	// nested group keys are moved to their flat aliases
+	err = queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Aggregate: &queries.Aggregation{
+			GroupBy:   []string{"person.org"},
+			Functions: []queries.Aggregate{{Op: queries.AVG, Key: "person.code", As: "avg"}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "person_org", Value: "$person.org"}}},
+			{Key: "avg", Value: bson.D{{Key: "$avg", Value: "$person.code"}}},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "person_org", Value: "$_id.person_org"}, {Key: "avg", Value: 1}}}},
+	}, query.pipeline)
+
+	err = queries.NewQueryBuilder(query).BuildQuery(&queries.MidQuery{
+		Aggregate: &queries.Aggregation{Functions: []queries.Aggregate{{Op: queries.MAX, Key: "$where", As: "max"}}},
+	})
+	assert.EqualError(t, err, `invalid key "$where": field name must not start with '$'`)
+}
@@ -0,0 +1,447 @@
+// Package odata maps the OData query options onto MidQuery, so that the backends
+// serve OData endpoints directly:
+//
+//	$filter=person/org eq 'A' and state in ('CA','WA')&$orderby=state desc,person/name&$top=2
+//
+// $filter supports the comparisons eq, ne, gt, ge, lt, le, the in operator,
+// the functions startswith and contains, and the logical operators and, or, not
+// with parentheses. Property paths use "/" as separator. The literals are
+// 'strings' (with doubled quotes inside), numbers, true, false, null and the date and
+// time values, e.g. 2021-06-01 or 2021-06-01T12:00:00Z.
+// $top sets the page size and $skiptoken the pagination token.
+package odata
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dmitsh/docdb/pkg/queries"
+)
+
+const (
+	FILTER    = "$filter"
+	ORDERBY   = "$orderby"
+	TOP       = "$top"
+	SKIPTOKEN = "$skiptoken"
+)
+
+// number is the OData grammar of the numeric literals; strconv.ParseFloat alone
+// would also accept Inf, NaN and hexadecimal numbers
+var number = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// ParseQuery parses the raw query string of the request URL
+func ParseQuery(rawQuery string) (*queries.MidQuery, error) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(values)
+}
+
+// Parse maps the OData query options onto a validated MidQuery. The parameters
+// without the "$" prefix are left to the caller; other system query options
+// are not supported.
+func Parse(values url.Values) (*queries.MidQuery, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mq := &queries.MidQuery{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "$") {
+			continue
+		}
+		if len(values[name]) != 1 {
+			return nil, fmt.Errorf("query option %s must be specified once", name)
+		}
+		value := values[name][0]
+		var err error
+		switch name {
+		case FILTER:
+			if mq.Filter, err = ParseFilter(value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", FILTER, err)
+			}
+		case ORDERBY:
+			if mq.Sort, err = ParseOrderBy(value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", ORDERBY, err)
+			}
+		case TOP:
+			if mq.Page.Limit, err = strconv.Atoi(value); err != nil || mq.Page.Limit < 0 {
+				return nil, fmt.Errorf("invalid %s: must be a non-negative integer, got %q", TOP, value)
+			}
+		case SKIPTOKEN:
+			mq.Page.Token = value
+		default:
+			return nil, fmt.Errorf("unsupported query option %s", name)
+		}
+	}
+	if err := mq.Validate(); err != nil {
+		return nil, err
+	}
+	return mq, nil
+}
+
+// ParseOrderBy parses the comma-separated property paths, each optionally followed by asc or desc
+func ParseOrderBy(value string) ([]queries.Sorting, error) {
+	ret := []queries.Sorting{}
+	for _, item := range strings.Split(value, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("expected property path [asc|desc], got %q", strings.TrimSpace(item))
+		}
+		s := queries.Sorting{Key: propertyKey(fields[0])}
+		if len(fields) == 2 {
+			switch fields[1] {
+			case "asc":
+				s.Order = queries.ASC
+			case "desc":
+				s.Order = queries.DESC
+			default:
+				return nil, fmt.Errorf("expected asc or desc, got %q", fields[1])
+			}
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// propertyKey converts the property path to the dotted key: person/name -> person.name
+func propertyKey(path string) string {
+	return strings.ReplaceAll(path, "/", ".")
+}
+
+// ParseFilter parses the $filter expression; the syntax errors are *queries.SyntaxError
+func ParseFilter(value string) (queries.Filter, error) {
+	toks, err := lex(value)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{text: value, toks: toks}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	return filter, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokLiteral // number or date
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of input"
+	}
+	return strconv.Quote(t.text)
+}
+
+func (t token) is(word string) bool {
+	return t.kind == tokIdent && t.text == word
+}
+
+func syntaxError(text string, offset int, format string, args ...interface{}) error {
+	return &queries.SyntaxError{
+		Offset: offset,
+		Line:   1 + strings.Count(text[:offset], "\n"),
+		Column: 1 + utf8.RuneCountInString(text[strings.LastIndexByte(text[:offset], '\n')+1:offset]),
+		Msg:    fmt.Sprintf(format, args...),
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '/' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func isLiteralChar(c byte) bool {
+	return c == '.' || c == ':' || c == '+' || c == '-' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func lex(text string) ([]token, error) {
+	toks := []token{}
+	for i := 0; i < len(text); {
+		c := text[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			toks = append(toks, token{kind: tokLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			toks = append(toks, token{kind: tokRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			toks = append(toks, token{kind: tokComma, text: ",", pos: i})
+			i++
+		case c == '\'':
+			var sb strings.Builder
+			for i++; ; i++ {
+				if i >= len(text) {
+					return nil, syntaxError(text, start, "unterminated string")
+				}
+				if text[i] == '\'' {
+					// a quote is escaped by another one
+					if i+1 < len(text) && text[i+1] == '\'' {
+						i++
+					} else {
+						break
+					}
+				}
+				sb.WriteByte(text[i])
+			}
+			i++
+			toks = append(toks, token{kind: tokString, text: sb.String(), pos: start})
+		case c == '-' || '0' <= c && c <= '9':
+			for i++; i < len(text) && isLiteralChar(text[i]); i++ {
+			}
+			toks = append(toks, token{kind: tokLiteral, text: text[start:i], pos: start})
+		case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+			for i++; i < len(text) && isIdentChar(text[i]); i++ {
+			}
+			toks = append(toks, token{kind: tokIdent, text: text[start:i], pos: start})
+		default:
+			r, _ := utf8.DecodeRuneInString(text[i:])
+			return nil, syntaxError(text, start, "unexpected character %q", r)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(text)}), nil
+}
+
+// reserved are the operators and literals, which are not property names
+var reserved = map[string]bool{
+	"and": true, "or": true, "not": true, "in": true,
+	"eq": true, "ne": true, "gt": true, "ge": true, "lt": true, "le": true,
+	"true": true, "false": true, "null": true,
+}
+
+type parser struct {
+	text string
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return syntaxError(p.text, t.pos, format, args...)
+}
+
+func (p *parser) expect(kind tokenKind, what string) error {
+	if t := p.next(); t.kind != kind {
+		return p.errorf(t, "expected %s, got %s", what, t)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (queries.Filter, error) {
+	return p.parseChain("or", p.parseAnd, func(filters []queries.Filter) queries.Filter {
+		return &queries.FilterOR{Filters: filters}
+	})
+}
+
+func (p *parser) parseAnd() (queries.Filter, error) {
+	return p.parseChain("and", p.parseUnary, func(filters []queries.Filter) queries.Filter {
+		return &queries.FilterAND{Filters: filters}
+	})
+}
+
+// parseChain parses the operands joined by the operator into a single filter
+func (p *parser) parseChain(op string, operand func() (queries.Filter, error), join func([]queries.Filter) queries.Filter) (queries.Filter, error) {
+	filters := []queries.Filter{}
+	for {
+		filter, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+		if !p.peek().is(op) {
+			break
+		}
+		p.next()
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return join(filters), nil
+}
+
+func (p *parser) parseUnary() (queries.Filter, error) {
+	t := p.peek()
+	switch {
+	case t.is("not"):
+		p.next()
+		filter, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &queries.FilterNOT{Filter: filter}, nil
+	case t.kind == tokLParen:
+		p.next()
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return filter, p.expect(tokRParen, `")"`)
+	case t.kind == tokIdent && p.toks[p.i+1].kind == tokLParen:
+		return p.parseFunction()
+	}
+	return p.parseComparison()
+}
+
+// parseFunction parses the boolean functions startswith(path, 'str') and contains(path, 'str')
+func (p *parser) parseFunction() (queries.Filter, error) {
+	name := p.next()
+	if name.text != "startswith" && name.text != "contains" {
+		return nil, p.errorf(name, "unsupported function %s", name)
+	}
+	p.next()
+	key, err := p.parseProperty()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expect(tokComma, `","`); err != nil {
+		return nil, err
+	}
+	str := p.next()
+	if str.kind != tokString {
+		return nil, p.errorf(str, "expected string, got %s", str)
+	}
+	if err = p.expect(tokRParen, `")"`); err != nil {
+		return nil, err
+	}
+	if name.text == "startswith" {
+		return &queries.FilterSTARTSWITH{Key: key, Val: str.text}, nil
+	}
+	return &queries.FilterCONTAINS{Key: key, Val: str.text}, nil
+}
+
+func (p *parser) parseProperty() (string, error) {
+	t := p.next()
+	if t.kind != tokIdent || reserved[t.text] {
+		return "", p.errorf(t, "expected property path, got %s", t)
+	}
+	if strings.HasSuffix(t.text, "/") || strings.Contains(t.text, "//") {
+		return "", p.errorf(t, "invalid property path %s", t)
+	}
+	return propertyKey(t.text), nil
+}
+
+func (p *parser) parseComparison() (queries.Filter, error) {
+	key, err := p.parseProperty()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if op.is("in") {
+		return p.parseIn(key)
+	}
+	if op.kind != tokIdent {
+		return nil, p.errorf(op, "expected operator, got %s", op)
+	}
+	switch op.text {
+	case "eq", "ne", "gt", "ge", "lt", "le":
+	default:
+		return nil, p.errorf(op, "unsupported operator %s", op)
+	}
+	val, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	switch op.text {
+	case "eq":
+		return &queries.FilterEQ{Key: key, Val: val}, nil
+	case "ne":
+		return &queries.FilterNE{Key: key, Val: val}, nil
+	case "gt":
+		return &queries.FilterGT{Key: key, Val: val}, nil
+	case "ge":
+		return &queries.FilterGTE{Key: key, Val: val}, nil
+	case "lt":
+		return &queries.FilterLT{Key: key, Val: val}, nil
+	default:
+		return &queries.FilterLTE{Key: key, Val: val}, nil
+	}
+}
+
+func (p *parser) parseIn(key string) (queries.Filter, error) {
+	if err := p.expect(tokLParen, `"("`); err != nil {
+		return nil, err
+	}
+	vals := []interface{}{}
+	for {
+		val, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	return &queries.FilterIN{Key: key, Vals: vals}, p.expect(tokRParen, `"," or ")"`)
+}
+
+// parseValue returns the value of the same type as in JSON queries
+func (p *parser) parseValue() (interface{}, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokString:
+		return t.text, nil
+	case t.kind == tokLiteral:
+		if number.MatchString(t.text) {
+			f, err := strconv.ParseFloat(t.text, 64)
+			if err != nil || math.IsInf(f, 0) {
+				return nil, p.errorf(t, "number %s is out of range", t)
+			}
+			return f, nil
+		}
+		// unlike the $date literals of MidQuery, the relative dates are not OData
+		if d, err := queries.ParseDate(t.text); err == nil && len(d.Expr) == 0 {
+			return d, nil
+		}
+		return nil, p.errorf(t, "invalid literal %s", t)
+	case t.is("true"):
+		return true, nil
+	case t.is("false"):
+		return false, nil
+	case t.is("null"):
+		return nil, nil
+	default:
+		return nil, p.errorf(t, "expected value, got %s", t)
+	}
+}
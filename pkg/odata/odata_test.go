@@ -0,0 +1,179 @@
+package odata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/dmitsh/docdb/pkg/cosmosdb"
+	"github.com/dmitsh/docdb/pkg/memdb"
+	"github.com/dmitsh/docdb/pkg/mongodb"
+	"github.com/dmitsh/docdb/pkg/queries"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		json  string
+	}{
+		{
+			query: ``,
+			json:  `{}`,
+		},
+		{
+			query: `$filter=state eq 'CA'&$top=2`,
+			json:  `{"filter": {"EQ": {"state": "CA"}}, "pagination": {"limit": 2}}`,
+		},
+		{
+			query: `$filter=person/org eq 'A' and state in ('CA','WA')&$orderby=state desc,person/name`,
+			json:  `{"filter": {"AND": [{"EQ": {"person.org": "A"}}, {"IN": {"state": ["CA", "WA"]}}]}, "sort": [{"key": "state", "order": "DESC"}, {"key": "person.name"}]}`,
+		},
+		{
+			query: url.Values{
+				"$filter":    {"person/org eq 'A' or (person/org eq 'B' and state in ('CA', 'WA'))"},
+				"$orderby":   {"state desc, person/name asc"},
+				"$top":       {"2"},
+				"$skiptoken": {"abc"},
+				"api-key":    {"ignored"},
+			}.Encode(),
+			json: `{"filter": {"OR": [{"EQ": {"person.org": "A"}}, {"AND": [{"EQ": {"person.org": "B"}}, {"IN": {"state": ["CA", "WA"]}}]}]}, ` +
+				`"sort": [{"key": "state", "order": "DESC"}, {"key": "person.name", "order": "ASC"}], "pagination": {"limit": 2, "token": "abc"}}`,
+		},
+		{
+			query: url.Values{"$filter": {"state ne 'CA' and city ge 'P' and person/name lt 'M' and person/code gt -1.5e3 and person/code le 1008"}}.Encode(),
+			json:  `{"filter": {"AND": [{"NE": {"state": "CA"}}, {"GTE": {"city": "P"}}, {"LT": {"person.name": "M"}}, {"GT": {"person.code": -1500}}, {"LTE": {"person.code": 1008}}]}}`,
+		},
+		{
+			query: url.Values{"$filter": {"not (startswith(person/name, 'J') or contains(city,'O''Hare')) and retired ne true and state ne null"}}.Encode(),
+			json: `{"filter": {"AND": [{"NOT": {"OR": [{"STARTSWITH": {"person.name": "J"}}, {"CONTAINS": {"city": "O'Hare"}}]}}, ` +
+				`{"NE": {"retired": true}}, {"NE": {"state": null}}]}}`,
+		},
+		{
+			query: url.Values{"$filter": {"joined ge 2021-06-01T02:00:00+02:00 and updated lt 2022-01-01 or deleted eq false"}}.Encode(),
+			json: `{"filter": {"OR": [{"AND": [{"GTE": {"joined": {"$date": "2021-06-01T00:00:00Z"}}}, {"LT": {"updated": {"$date": "2022-01-01"}}}]}, ` +
+				`{"EQ": {"deleted": false}}]}}`,
+		},
+	}
+	for _, test := range tests {
+		var expected queries.MidQuery
+		require.NoError(t, json.Unmarshal([]byte(test.json), &expected))
+		mq, err := ParseQuery(test.query)
+		require.NoError(t, err, test.query)
+		assert.Equal(t, &expected, mq, test.query)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		values url.Values
+		err    string
+	}{
+		{
+			values: url.Values{"$filter": {"state eq 'CA' and"}},
+			err:    `invalid $filter: syntax error at line 1, column 18: expected property path, got end of input`,
+		},
+		{
+			values: url.Values{"$filter": {"state = 'CA'"}},
+			err:    `invalid $filter: syntax error at line 1, column 7: unexpected character '='`,
+		},
+		{
+			values: url.Values{"$filter": {"state has 'CA'"}},
+			err:    `invalid $filter: syntax error at line 1, column 7: unsupported operator "has"`,
+		},
+		{
+			values: url.Values{"$filter": {"endswith(city, 'le')"}},
+			err:    `invalid $filter: syntax error at line 1, column 1: unsupported function "endswith"`,
+		},
+		{
+			values: url.Values{"$filter": {"(state eq 'CA' or state eq 'WA'"}},
+			err:    `invalid $filter: syntax error at line 1, column 32: expected ")", got end of input`,
+		},
+		{
+			values: url.Values{"$filter": {"state eq 'CA"}},
+			err:    `invalid $filter: syntax error at line 1, column 10: unterminated string`,
+		},
+		{
+			values: url.Values{"$filter": {"joined gt 2021-13-01"}},
+			err:    `invalid $filter: syntax error at line 1, column 11: invalid literal "2021-13-01"`,
+		},
+		{
+			values: url.Values{"$filter": {"person/code gt -Inf"}},
+			err:    `invalid $filter: syntax error at line 1, column 16: invalid literal "-Inf"`,
+		},
+		{
+			values: url.Values{"$filter": {"person/code eq 0x1p-2"}},
+			err:    `invalid $filter: syntax error at line 1, column 16: invalid literal "0x1p-2"`,
+		},
+		{
+			values: url.Values{"$filter": {"person/code lt 1e400"}},
+			err:    `invalid $filter: syntax error at line 1, column 16: number "1e400" is out of range`,
+		},
+		{
+			values: url.Values{"$filter": {"state eq 'CA' state eq 'WA'"}},
+			err:    `invalid $filter: syntax error at line 1, column 15: unexpected "state"`,
+		},
+		{
+			values: url.Values{"$orderby": {"state descending"}},
+			err:    `invalid $orderby: expected asc or desc, got "descending"`,
+		},
+		{
+			values: url.Values{"$orderby": {"state,,city"}},
+			err:    `invalid $orderby: expected property path [asc|desc], got ""`,
+		},
+		{
+			values: url.Values{"$top": {"-1"}},
+			err:    `invalid $top: must be a non-negative integer, got "-1"`,
+		},
+		{
+			values: url.Values{"$top": {"1", "2"}},
+			err:    `query option $top must be specified once`,
+		},
+		{
+			values: url.Values{"$skip": {"10"}},
+			err:    `unsupported query option $skip`,
+		},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.values)
+		assert.EqualError(t, err, test.err)
+	}
+
+	_, err := ParseQuery(url.Values{"$filter": {"state eq 'CA' or city eq"}}.Encode())
+	var serr *queries.SyntaxError
+	require.True(t, errors.As(err, &serr))
+	assert.Equal(t, 24, serr.Offset)
+}
+
+func TestBackends(t *testing.T) {
+	mq, err := ParseQuery(url.Values{
+		"$filter":  {"person/org eq 'A' or (person/org eq 'B' and state in ('CA','WA'))"},
+		"$orderby": {"state desc,person/name"},
+		"$top":     {"2"},
+	}.Encode())
+	require.NoError(t, err)
+
+	for _, visitor := range []queries.Visitor{&mongodb.Query{}, &cosmosdb.Query{}} {
+		assert.NoError(t, queries.NewQueryBuilder(visitor).BuildQuery(mq))
+	}
+
+	ctx := context.Background()
+	db, err := memdb.GetDB(ctx, map[string]string{"data": "../../tests/dataset.json"})
+	require.NoError(t, err)
+	query := &memdb.Query{}
+	require.NoError(t, queries.NewQueryBuilder(query).BuildQuery(mq))
+	pager := queries.NewPager(db, query, mq, queries.NewTokenCodec("memory", nil))
+	names := []string{}
+	for !pager.Done() {
+		ret, err := pager.Next(ctx)
+		require.NoError(t, err)
+		for _, doc := range ret {
+			name, _ := queries.LookupPath(doc, "person.name")
+			names = append(names, name.(string))
+		}
+	}
+	assert.Equal(t, []string{"John", "Leo", "Peter", "Ann", "Mike", "Nick"}, names)
+}
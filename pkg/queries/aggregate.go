@@ -0,0 +1,216 @@
+package queries
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	AGGREGATE = "aggregate"
+
+	COUNT = "COUNT"
+	SUM   = "SUM"
+	AVG   = "AVG"
+	MIN   = "MIN"
+	MAX   = "MAX"
+)
+
+// Aggregate is an aggregate function over the key; COUNT counts the documents
+// and takes no key. The result is returned under the alias As, which defaults
+// to the lower-case function name followed by the key, e.g. "sum_person_code".
+type Aggregate struct {
+	Op  string `json:"op"`
+	Key string `json:"key,omitempty"`
+	As  string `json:"as,omitempty"`
+}
+
+// Aggregation groups the filtered documents by the GroupBy keys and computes
+// the aggregate functions for every group. Each result row contains the group
+// keys under their aliases (see GroupAlias) and the aggregated values.
+// The MidQuery sort keys refer to these aliases.
+type Aggregation struct {
+	GroupBy   []string    `json:"groupBy,omitempty"`
+	Functions []Aggregate `json:"functions"`
+}
+
+// GroupAlias returns the name of the group key in the result rows: "person.org" -> "person_org"
+func GroupAlias(key string) string {
+	return strings.ReplaceAll(key, ".", "_")
+}
+
+// Aliases returns the names of the fields of the result rows
+func (a *Aggregation) Aliases() []string {
+	ret := []string{}
+	for _, key := range a.GroupBy {
+		ret = append(ret, GroupAlias(key))
+	}
+	for _, f := range a.Functions {
+		ret = append(ret, f.As)
+	}
+	return ret
+}
+
+func parseAggregation(obj interface{}) (*Aggregation, error) {
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%q must be a map", AGGREGATE)
+	}
+	if err := checkKeys(m, "groupBy", "functions"); err != nil {
+		return nil, err
+	}
+	if err := checkStrings(m["groupBy"], "group key"); err != nil {
+		return nil, atPath("groupBy", err)
+	}
+	if v, found := m["functions"]; found {
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil, atPath("functions", fmt.Errorf("%q functions must be an array", AGGREGATE))
+		}
+		for i, entry := range arr {
+			if err := checkFunction(entry); err != nil {
+				return nil, atPath("functions", atIndex(i, err))
+			}
+		}
+	}
+	jdata, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	a := &Aggregation{}
+	if err = json.Unmarshal(jdata, a); err != nil {
+		return nil, err
+	}
+	return a, a.validate()
+}
+
+// checkStrings checks that the value, if set, is an array of strings
+func checkStrings(v interface{}, name string) error {
+	if v == nil {
+		return nil
+	}
+	arr, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("%q %ss must be an array", AGGREGATE, name)
+	}
+	for i, entry := range arr {
+		if _, ok := entry.(string); !ok {
+			return atIndex(i, fmt.Errorf("%q %s must be a string", AGGREGATE, name))
+		}
+	}
+	return nil
+}
+
+// checkFunction checks the entry of the function list before it is decoded
+func checkFunction(entry interface{}) error {
+	f, ok := entry.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%q function must be a map", AGGREGATE)
+	}
+	if err := checkKeys(f, "op", "key", "as"); err != nil {
+		return err
+	}
+	for _, k := range []string{"op", "key", "as"} {
+		if v, found := f[k]; found {
+			if _, ok := v.(string); !ok {
+				return atPath(k, fmt.Errorf("%q function %s must be a string", AGGREGATE, k))
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the aggregation and sets the default aliases
+func (a *Aggregation) validate() error {
+	if len(a.Functions) == 0 {
+		return atPath("functions", fmt.Errorf("%q must contain at least one function", AGGREGATE))
+	}
+	for i, key := range a.GroupBy {
+		if len(key) == 0 {
+			return atPath("groupBy", atIndex(i, fmt.Errorf("%q must contain non-empty group keys", AGGREGATE)))
+		}
+	}
+	for i := range a.Functions {
+		f := &a.Functions[i]
+		f.Op = strings.ToUpper(f.Op)
+		var err error
+		switch f.Op {
+		case COUNT:
+			if len(f.Key) != 0 {
+				err = atPath("key", fmt.Errorf("%s function takes no key", COUNT))
+			}
+		case SUM, AVG, MIN, MAX:
+			if len(f.Key) == 0 {
+				err = atPath("key", fmt.Errorf("%s function requires a key", f.Op))
+			}
+		default:
+			err = atPath("op", fmt.Errorf("unsupported aggregate function %q", f.Op))
+		}
+		if err != nil {
+			return atPath("functions", atIndex(i, err))
+		}
+		if len(f.As) == 0 {
+			f.As = strings.ToLower(f.Op)
+			if len(f.Key) != 0 {
+				f.As += "_" + GroupAlias(f.Key)
+			}
+		}
+	}
+	seen := map[string]bool{}
+	for i, alias := range a.Aliases() {
+		var err error
+		if !isAlias(alias) {
+			err = fmt.Errorf("invalid aggregate alias %q", alias)
+		} else if seen[alias] {
+			err = fmt.Errorf("duplicate aggregate alias %q", alias)
+		}
+		if err != nil {
+			// the aliases of the group keys come first
+			if i < len(a.GroupBy) {
+				return atPath("groupBy", atIndex(i, err))
+			}
+			return atPath("functions", atIndex(i-len(a.GroupBy), atPath("as", err)))
+		}
+		seen[alias] = true
+	}
+	return nil
+}
+
+// isAlias accepts identifiers, which are valid field names in every backend
+func isAlias(str string) bool {
+	if len(str) == 0 {
+		return false
+	}
+	for i, r := range str {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SortDocuments sorts the documents in place by the (dotted) sort keys, see CompareValues
+func SortDocuments(docs []interface{}, keys []Sorting) {
+	if len(keys) == 0 {
+		return
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, s := range keys {
+			x, _ := LookupPath(docs[i], s.Key)
+			y, _ := LookupPath(docs[j], s.Key)
+			ret := CompareValues(x, y)
+			if ret == 0 {
+				continue
+			}
+			if s.Order == DESC {
+				return ret > 0
+			}
+			return ret < 0
+		}
+		return false
+	})
+}
@@ -0,0 +1,158 @@
+package queries
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// DATE is the key of a time literal in filter values:
+//
+//	{"$date": "2021-06-01T12:00:00+02:00"}, {"$date": "2021-06-01"}, {"$date": "now-7d"}
+//
+// A relative expression is "now", optionally followed by an offset with one of
+// the units s, m, h, d (24 hours) or w (7 days).
+const DATE = "$date"
+
+// CosmosTimeFormat is the UTC ISO-8601 format recommended for datetime strings in Cosmos DB.
+// Its strings of fixed width sort in chronological order.
+const CosmosTimeFormat = "2006-01-02T15:04:05.0000000Z"
+
+// now is replaced in tests
+var now = time.Now
+
+var relativeDate = regexp.MustCompile(`^now(?:([+-])(\d+)([smhdw]))?$`)
+
+var dateUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// Date is a point in time of a filter value, normalized to UTC. For relative
+// literals, Expr keeps the expression, which is resolved at parse time.
+type Date struct {
+	Time time.Time
+	Expr string
+}
+
+func (d Date) String() string {
+	return d.Time.Format(time.RFC3339Nano)
+}
+
+// ParseDate parses the value of a time literal
+func ParseDate(str string) (Date, error) {
+	if m := relativeDate.FindStringSubmatch(str); m != nil {
+		t := now()
+		if len(m[1]) != 0 {
+			n, err := strconv.ParseInt(m[2], 10, 32)
+			if err != nil {
+				return Date{}, fmt.Errorf("invalid date %q: %v", str, err)
+			}
+			unit := dateUnits[m[3]]
+			if n > int64(math.MaxInt64/unit) {
+				return Date{}, fmt.Errorf("invalid date %q: offset is out of range", str)
+			}
+			offset := time.Duration(n) * unit
+			if m[1] == "-" {
+				offset = -offset
+			}
+			t = t.Add(offset)
+		}
+		return Date{Time: t.UTC(), Expr: str}, nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if t, err := time.Parse(layout, str); err == nil {
+			return Date{Time: t.UTC()}, nil
+		}
+	}
+	return Date{}, fmt.Errorf("invalid date %q: expected RFC 3339 time, YYYY-MM-DD or now[+-]N(s|m|h|d|w)", str)
+}
+
+func parseDate(t string, v interface{}) (interface{}, error) {
+	str, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s filter has invalid %q value: must be a string", t, DATE)
+	}
+	d, err := ParseDate(str)
+	if err != nil {
+		return nil, fmt.Errorf("%s filter has %v", t, err)
+	}
+	return d, nil
+}
+
+// toTime converts dates to time. RFC 3339 strings, as stored in JSON documents,
+// are converted only when parseStrings is set, i.e. when they are compared with
+// a time literal of the filter.
+func toTime(v interface{}, parseStrings bool) (time.Time, bool) {
+	switch val := v.(type) {
+	case Date:
+		return val.Time, true
+	case time.Time:
+		return val, true
+	case string:
+		if !parseStrings {
+			return time.Time{}, false
+		}
+		t, err := time.Parse(time.RFC3339Nano, val)
+		return t, err == nil
+	default:
+		return time.Time{}, false
+	}
+}
+
+// ConvertDates returns a copy of the document, with the time literals in the
+// Extended JSON form {"$date": "..."} replaced by conv of their UTC time. The
+// backends use it in Populate to store the dates in their native format.
+func ConvertDates(doc interface{}, conv func(time.Time) interface{}) (interface{}, error) {
+	switch val := doc.(type) {
+	case map[string]interface{}:
+		if expr, ok := val[DATE]; ok && len(val) == 1 {
+			str, ok := expr.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid %q value: must be a string", DATE)
+			}
+			d, err := ParseDate(str)
+			if err != nil {
+				return nil, err
+			}
+			if len(d.Expr) != 0 {
+				return nil, fmt.Errorf("invalid date %q: relative dates are not allowed in documents", str)
+			}
+			return conv(d.Time), nil
+		}
+		ret := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			var err error
+			if ret[k], err = ConvertDates(v, conv); err != nil {
+				return nil, atPath(k, err)
+			}
+		}
+		return ret, nil
+	case []interface{}:
+		ret := make([]interface{}, len(val))
+		for i, v := range val {
+			var err error
+			if ret[i], err = ConvertDates(v, conv); err != nil {
+				return nil, atIndex(i, err)
+			}
+		}
+		return ret, nil
+	default:
+		return doc, nil
+	}
+}
+
+// MarshalJSON writes the time literal, keeping the expression of a relative date
+func (d Date) MarshalJSON() ([]byte, error) {
+	str := d.Expr
+	if len(str) == 0 {
+		str = d.String()
+	}
+	return json.Marshal(map[string]string{DATE: str})
+}
@@ -0,0 +1,102 @@
+package queries
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDate(t *testing.T) {
+	defer func(f func() time.Time) { now = f }(now)
+	now = func() time.Time { return time.Date(2021, 6, 15, 14, 0, 0, 0, time.FixedZone("PDT", -7*3600)) }
+
+	tests := []struct {
+		input string
+		time  time.Time
+		expr  string
+		err   string
+	}{
+		{input: "2021-06-01T02:00:00+02:00", time: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{input: "2021-06-01T00:00:00.123Z", time: time.Date(2021, 6, 1, 0, 0, 0, 123000000, time.UTC)},
+		{input: "2021-06-01", time: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{input: "now", time: time.Date(2021, 6, 15, 21, 0, 0, 0, time.UTC), expr: "now"},
+		{input: "now-7d", time: time.Date(2021, 6, 8, 21, 0, 0, 0, time.UTC), expr: "now-7d"},
+		{input: "now+2w", time: time.Date(2021, 6, 29, 21, 0, 0, 0, time.UTC), expr: "now+2w"},
+		{input: "now-90m", time: time.Date(2021, 6, 15, 19, 30, 0, 0, time.UTC), expr: "now-90m"},
+		{input: "now-7", err: `invalid date "now-7": expected RFC 3339 time, YYYY-MM-DD or now[+-]N(s|m|h|d|w)`},
+		{input: "now-2000000000d", err: `invalid date "now-2000000000d": offset is out of range`},
+		{input: "now+300000w", err: `invalid date "now+300000w": offset is out of range`},
+		{input: "06/01/2021", err: `invalid date "06/01/2021": expected RFC 3339 time, YYYY-MM-DD or now[+-]N(s|m|h|d|w)`},
+	}
+	for _, test := range tests {
+		d, err := ParseDate(test.input)
+		if len(test.err) != 0 {
+			assert.EqualError(t, err, test.err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, Date{Time: test.time, Expr: test.expr}, d, test.input)
+	}
+
+	// relative dates keep the fingerprint of the query
+	var mq MidQuery
+	assert.NoError(t, json.Unmarshal([]byte(`{"filter": {"GTE": {"updated": {"$date": "now-1h"}}}}`), &mq))
+	fp, err := Fingerprint(&mq)
+	assert.NoError(t, err)
+	now = func() time.Time { return time.Date(2021, 6, 16, 0, 0, 0, 0, time.UTC) }
+	assert.NoError(t, json.Unmarshal([]byte(`{"filter": {"GTE": {"updated": {"$date": "now-1h"}}}}`), &mq))
+	same, err := Fingerprint(&mq)
+	assert.NoError(t, err)
+	assert.Equal(t, fp, same)
+}
+
+func TestCompareDates(t *testing.T) {
+	d := Date{Time: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	tests := []struct {
+		val interface{}
+		ret int
+		ok  bool
+	}{
+		{val: "2021-06-01T02:00:00+02:00", ret: 0, ok: true},
+		{val: "2021-06-01T00:00:00.0000000Z", ret: 0, ok: true},
+		{val: "2021-05-31T20:00:01-04:00", ret: 1, ok: true},
+		{val: "2021-05-31T23:59:59Z", ret: -1, ok: true},
+		{val: Date{Time: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}, ret: 1, ok: true},
+		{val: "June 1st", ok: false},
+		{val: float64(1622505600), ok: false},
+	}
+	for _, test := range tests {
+		ret, ok := CompareScalars(test.val, d)
+		assert.Equal(t, test.ok, ok, "%v", test.val)
+		assert.Equal(t, test.ret, ret, "%v", test.val)
+	}
+
+	// only the time literals of the filters turn strings into points in time
+	_, ok := CompareScalars(d.Time, "2021-06-01T00:00:00Z")
+	assert.False(t, ok)
+	ret, ok := CompareScalars("2021-06-01T02:00:00+02:00", "2021-06-01T00:00:00Z")
+	assert.True(t, ok)
+	assert.Equal(t, 1, ret)
+}
+
+func TestConvertDates(t *testing.T) {
+	doc := map[string]interface{}{
+		"joined": map[string]interface{}{DATE: "2021-06-01T02:00:00+02:00"},
+		"visits": []interface{}{map[string]interface{}{"at": map[string]interface{}{DATE: "2021-06-02"}}},
+		"note":   map[string]interface{}{DATE: "x", "other": 1},
+	}
+	ret, err := ConvertDates(doc, func(t time.Time) interface{} { return t.Format(CosmosTimeFormat) })
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"joined": "2021-06-01T00:00:00.0000000Z",
+		"visits": []interface{}{map[string]interface{}{"at": "2021-06-02T00:00:00.0000000Z"}},
+		"note":   map[string]interface{}{DATE: "x", "other": 1},
+	}, ret)
+	// the input is left unchanged
+	assert.Equal(t, map[string]interface{}{DATE: "2021-06-01T02:00:00+02:00"}, doc["joined"])
+
+	_, err = ConvertDates(map[string]interface{}{"visits": []interface{}{map[string]interface{}{DATE: "now-1d"}}}, nil)
+	assert.EqualError(t, err, `/visits/0: invalid date "now-1d": relative dates are not allowed in documents`)
+}
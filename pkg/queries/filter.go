@@ -2,6 +2,8 @@ package queries
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 )
 
 type FilterType int
@@ -10,56 +12,386 @@ type Filter interface {
 	Parse(interface{}) error
 }
 
+// IGNORECASE is the flag next to the operator of a filter unit, which makes
+// the string comparison case-insensitive: {"STARTSWITH": {"person.name": "ja"}, "ignoreCase": true}
+const IGNORECASE = "ignoreCase"
+
 func parseFilter(obj interface{}) (Filter, error) {
 	m, ok := obj.(map[string]interface{})
 	if !ok {
 		return nil, fmt.Errorf("Filter unit must be a map")
 	}
-	if len(m) > 1 {
+	size := len(m)
+	var ignoreCase bool
+	if v, found := m[IGNORECASE]; found {
+		if ignoreCase, ok = v.(bool); !ok {
+			return nil, atPath(IGNORECASE, fmt.Errorf("%q must be a boolean", IGNORECASE))
+		}
+		size--
+	}
+	if size > 1 {
 		return nil, fmt.Errorf("Filter unit must have a single element")
 	}
 	for k, v := range m {
+		var f Filter
 		switch k {
+		case IGNORECASE:
+			continue
 		case "EQ":
-			f := &FilterEQ{}
-			err := f.Parse(v)
-			return f, err
-
+			f = &FilterEQ{}
+		case "NE":
+			f = &FilterNE{}
+		case "GT":
+			f = &FilterGT{}
+		case "GTE":
+			f = &FilterGTE{}
+		case "LT":
+			f = &FilterLT{}
+		case "LTE":
+			f = &FilterLTE{}
 		case "IN":
-			f := &FilterIN{}
-			err := f.Parse(v)
-			return f, err
-
+			f = &FilterIN{}
+		case "BETWEEN":
+			f = &FilterBETWEEN{}
+		case "STARTSWITH":
+			f = &FilterSTARTSWITH{}
+		case "CONTAINS":
+			f = &FilterCONTAINS{}
+		case "REGEX":
+			f = &FilterREGEX{}
+		case "EXISTS", "ISDEFINED":
+			f = &FilterEXISTS{}
+		case "ISNULL":
+			f = &FilterISNULL{}
+		case "ARRAY_CONTAINS":
+			f = &FilterARRAYCONTAINS{}
+		case "ANY", "ELEMMATCH":
+			f = &FilterANY{}
 		case "AND":
-			f := &FilterAND{}
-			err := f.Parse(v)
-			return f, err
-
+			f = &FilterAND{}
 		case "OR":
-			f := &FilterOR{}
-			err := f.Parse(v)
-			return f, err
+			f = &FilterOR{}
+		case "NOT":
+			f = &FilterNOT{}
+		default:
+			return nil, atPath(k, fmt.Errorf("unsupported filter operator %q", k))
+		}
+		if err := f.Parse(v); err != nil {
+			return f, atPath(k, err)
+		}
+		if ignoreCase {
+			return f, atPath(IGNORECASE, setIgnoreCase(k, f))
 		}
+		return f, nil
+	}
+	if ignoreCase {
+		return nil, fmt.Errorf("%q must be next to a filter", IGNORECASE)
 	}
 	return nil, nil
 }
 
+// setIgnoreCase applies the ignoreCase flag to the filters comparing strings
+func setIgnoreCase(t string, filter Filter) error {
+	switch f := filter.(type) {
+	case *FilterEQ:
+		if _, ok := f.Val.(string); !ok {
+			return fmt.Errorf("%q requires a string value in %s filter", IGNORECASE, t)
+		}
+		f.IgnoreCase = true
+	case *FilterSTARTSWITH:
+		f.IgnoreCase = true
+	case *FilterCONTAINS:
+		f.IgnoreCase = true
+	case *FilterREGEX:
+		f.IgnoreCase = true
+	default:
+		return fmt.Errorf("%q is not supported by %s filter", IGNORECASE, t)
+	}
+	return nil
+}
+
 type FilterEQ struct {
 	Key string
 	Val interface{}
+	// compare strings case-insensitively
+	IgnoreCase bool
+}
+
+func (f *FilterEQ) Parse(obj interface{}) (err error) {
+	f.Key, f.Val, err = parseKeyValue("EQ", obj)
+	return
+}
+
+type FilterNE struct {
+	Key string
+	Val interface{}
+}
+
+func (f *FilterNE) Parse(obj interface{}) (err error) {
+	f.Key, f.Val, err = parseKeyValue("NE", obj)
+	return
+}
+
+type FilterGT struct {
+	Key string
+	Val interface{}
+}
+
+func (f *FilterGT) Parse(obj interface{}) (err error) {
+	f.Key, f.Val, err = parseKeyValue("GT", obj)
+	return
+}
+
+type FilterGTE struct {
+	Key string
+	Val interface{}
+}
+
+func (f *FilterGTE) Parse(obj interface{}) (err error) {
+	f.Key, f.Val, err = parseKeyValue("GTE", obj)
+	return
 }
 
-func (f *FilterEQ) Parse(obj interface{}) error {
+type FilterLT struct {
+	Key string
+	Val interface{}
+}
+
+func (f *FilterLT) Parse(obj interface{}) (err error) {
+	f.Key, f.Val, err = parseKeyValue("LT", obj)
+	return
+}
+
+type FilterLTE struct {
+	Key string
+	Val interface{}
+}
+
+func (f *FilterLTE) Parse(obj interface{}) (err error) {
+	f.Key, f.Val, err = parseKeyValue("LTE", obj)
+	return
+}
+
+func parseKeyValue(t string, obj interface{}) (string, interface{}, error) {
 	m, ok := obj.(map[string]interface{})
 	if !ok {
-		return fmt.Errorf("EQ filter must be a map")
+		return "", nil, fmt.Errorf("%s filter must be a map", t)
 	}
 	if len(m) != 1 {
-		return fmt.Errorf("EQ filter must contain a single key/value pair")
+		return "", nil, fmt.Errorf("%s filter must contain a single key/value pair", t)
+	}
+	for k, v := range m {
+		v, err := parseValue(t, v)
+		if err != nil {
+			return "", nil, err
+		}
+		return k, v, nil
+	}
+	return "", nil, nil
+}
+
+// FilterSTARTSWITH matches the string fields starting with the value
+type FilterSTARTSWITH struct {
+	Key        string
+	Val        string
+	IgnoreCase bool
+}
+
+func (f *FilterSTARTSWITH) Parse(obj interface{}) (err error) {
+	f.Key, f.Val, err = parseKeyString("STARTSWITH", obj)
+	return
+}
+
+// FilterCONTAINS matches the string fields containing the value
+type FilterCONTAINS struct {
+	Key        string
+	Val        string
+	IgnoreCase bool
+}
+
+func (f *FilterCONTAINS) Parse(obj interface{}) (err error) {
+	f.Key, f.Val, err = parseKeyString("CONTAINS", obj)
+	return
+}
+
+// FilterREGEX matches the string fields against the regular expression. The backends
+// differ in the regex dialect (Go RE2, PCRE), so the pattern should stick to the
+// common syntax; it is validated with the Go regexp package.
+type FilterREGEX struct {
+	Key        string
+	Pattern    string
+	IgnoreCase bool
+}
+
+func (f *FilterREGEX) Parse(obj interface{}) (err error) {
+	if f.Key, f.Pattern, err = parseKeyString("REGEX", obj); err != nil {
+		return
+	}
+	if _, err = regexp.Compile(f.Pattern); err != nil {
+		err = fmt.Errorf("REGEX filter has invalid pattern: %v", err)
+	}
+	return
+}
+
+func parseKeyString(t string, obj interface{}) (string, string, error) {
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return "", "", fmt.Errorf("%s filter must be a map", t)
+	}
+	if len(m) != 1 {
+		return "", "", fmt.Errorf("%s filter must contain a single key/value pair", t)
+	}
+	for k, v := range m {
+		str, ok := v.(string)
+		if !ok {
+			return "", "", fmt.Errorf("%s filter value must be a string", t)
+		}
+		return k, str, nil
+	}
+	return "", "", nil
+}
+
+// FilterEXISTS matches the documents having the field, whatever its value,
+// including null. ISDEFINED is accepted as an alias. Combined with NOT, it
+// matches the documents without the field.
+type FilterEXISTS struct {
+	Key string
+}
+
+func (f *FilterEXISTS) Parse(obj interface{}) (err error) {
+	f.Key, err = parseKey("EXISTS", obj)
+	return
+}
+
+// FilterISNULL matches the documents having the field set to null; a missing
+// field is not null. Unlike EQ null, whose handling of missing fields differs
+// across backends, EXISTS and ISNULL have the same semantics in all of them.
+type FilterISNULL struct {
+	Key string
+}
+
+func (f *FilterISNULL) Parse(obj interface{}) (err error) {
+	f.Key, err = parseKey("ISNULL", obj)
+	return
+}
+
+// FilterARRAYCONTAINS matches the array fields having an element equal to the value
+type FilterARRAYCONTAINS struct {
+	Key string
+	Val interface{}
+}
+
+func (f *FilterARRAYCONTAINS) Parse(obj interface{}) (err error) {
+	f.Key, f.Val, err = parseKeyValue("ARRAY_CONTAINS", obj)
+	return
+}
+
+// FilterANY matches the array fields having an element that satisfies the filter,
+// whose keys are relative to the element: {"ANY": {"addresses": {"EQ": {"city": "Seattle"}}}}.
+// ELEMMATCH is accepted as an alias.
+type FilterANY struct {
+	Key    string
+	Filter Filter
+}
+
+func (f *FilterANY) Parse(obj interface{}) error {
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("ANY filter must be a map")
+	}
+	if len(m) != 1 {
+		return fmt.Errorf("ANY filter must contain a single key/filter pair")
+	}
+	for k, v := range m {
+		if len(k) == 0 {
+			return fmt.Errorf("ANY filter must have a non-empty key")
+		}
+		f.Key = k
+		if _, ok := v.(map[string]interface{}); !ok {
+			return fmt.Errorf("ANY filter must contain a filter")
+		}
+		filter, err := parseFilter(v)
+		if err != nil {
+			return atPath(k, err)
+		}
+		if filter == nil {
+			return fmt.Errorf("ANY filter must contain a filter")
+		}
+		f.Filter = filter
+	}
+	return nil
+}
+
+func parseKey(t string, obj interface{}) (string, error) {
+	key, ok := obj.(string)
+	if !ok || len(key) == 0 {
+		return "", fmt.Errorf("%s filter must be a non-empty key", t)
+	}
+	return key, nil
+}
+
+// FilterBETWEEN matches the values within the range. Each bound is either inclusive
+// or exclusive: {"BETWEEN": {"person.code": {"gte": 1003, "lt": 1007}}}.
+// The bounds must be both numbers, both strings or both dates.
+type FilterBETWEEN struct {
+	Key            string
+	Lower          interface{}
+	Upper          interface{}
+	LowerInclusive bool
+	UpperInclusive bool
+}
+
+func (f *FilterBETWEEN) Parse(obj interface{}) error {
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("BETWEEN filter must be a map")
+	}
+	if len(m) != 1 {
+		return fmt.Errorf("BETWEEN filter must contain a single key/range pair")
 	}
 	for k, v := range m {
 		f.Key = k
-		f.Val = v
+		bounds, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("BETWEEN filter range must be a map")
+		}
+		var lower, upper int
+		for op, val := range bounds {
+			val, err := parseValue("BETWEEN", val)
+			if err != nil {
+				return err
+			}
+			switch strings.ToUpper(op) {
+			case "GT", "GTE":
+				f.Lower, f.LowerInclusive = val, strings.ToUpper(op) == "GTE"
+				lower++
+			case "LT", "LTE":
+				f.Upper, f.UpperInclusive = val, strings.ToUpper(op) == "LTE"
+				upper++
+			default:
+				return fmt.Errorf("BETWEEN filter has unsupported bound %q", op)
+			}
+		}
+		if lower != 1 || upper != 1 {
+			return fmt.Errorf("BETWEEN filter must have a lower (gt, gte) and an upper (lt, lte) bound")
+		}
+	}
+	return f.checkBounds()
+}
+
+// checkBounds checks that the bounds are of the same ordered type and form a range
+func (f *FilterBETWEEN) checkBounds() error {
+	for _, bound := range []interface{}{f.Lower, f.Upper} {
+		if c := valueClass(bound); c != classNumber && c != classString && c != classDate {
+			return fmt.Errorf("BETWEEN filter bounds must be numbers, strings or dates, got %T", bound)
+		}
+	}
+	ret, ok := CompareScalars(f.Lower, f.Upper)
+	if !ok || valueClass(f.Lower) != valueClass(f.Upper) {
+		return fmt.Errorf("BETWEEN filter has bounds of mismatched types %T and %T", f.Lower, f.Upper)
+	}
+	if ret > 0 {
+		return fmt.Errorf("BETWEEN filter has lower bound greater than upper bound")
 	}
 	return nil
 }
@@ -80,7 +412,16 @@ func (f *FilterIN) Parse(obj interface{}) error {
 	for k, v := range m {
 		f.Key = k
 		if f.Vals, ok = v.([]interface{}); !ok {
-			return fmt.Errorf("IN filter value must be an array")
+			return atPath(k, fmt.Errorf("IN filter value must be an array"))
+		}
+		if len(f.Vals) == 0 {
+			return atPath(k, fmt.Errorf("IN filter value must not be empty"))
+		}
+		for i, val := range f.Vals {
+			var err error
+			if f.Vals[i], err = parseValue("IN", val); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -104,6 +445,21 @@ func (f *FilterOR) Parse(obj interface{}) (err error) {
 	return
 }
 
+type FilterNOT struct {
+	Filter Filter
+}
+
+func (f *FilterNOT) Parse(obj interface{}) (err error) {
+	if _, ok := obj.(map[string]interface{}); !ok {
+		return fmt.Errorf("NOT filter must be a map")
+	}
+	f.Filter, err = parseFilter(obj)
+	if err == nil && f.Filter == nil {
+		err = fmt.Errorf("NOT filter must contain a filter")
+	}
+	return
+}
+
 func parseFilters(t string, obj interface{}) ([]Filter, error) {
 	arr, ok := obj.([]interface{})
 	if !ok {
@@ -116,7 +472,10 @@ func parseFilters(t string, obj interface{}) ([]Filter, error) {
 	for i, entry := range arr {
 		var err error
 		if filters[i], err = parseFilter(entry); err != nil {
-			return nil, err
+			return nil, atIndex(i, err)
+		}
+		if filters[i] == nil {
+			return nil, atIndex(i, fmt.Errorf("%s filter entry must contain a filter", t))
 		}
 	}
 	return filters, nil
@@ -0,0 +1,260 @@
+package queries
+
+import (
+	"time"
+)
+
+// Sort orders of Builder.OrderBy
+const (
+	Asc  = ASC
+	Desc = DESC
+)
+
+// Builder constructs a MidQuery in code, without a round trip through JSON:
+//
+//	mq, err := queries.Where(queries.Eq("state", "CA")).
+//		And(queries.In("person.org", "A", "B")).
+//		OrderBy("state", queries.Desc).
+//		Limit(10).
+//		Build()
+//
+// The query returned by Build is validated and ready for QueryBuilder.BuildQuery.
+type Builder struct {
+	mq MidQuery
+}
+
+// Where starts a query matching all the filters; no filters match all documents
+func Where(filters ...Filter) *Builder {
+	return (&Builder{}).And(filters...)
+}
+
+// And requires the filters in addition to the current filter
+func (b *Builder) And(filters ...Filter) *Builder {
+	b.mq.Filter = combine(b.mq.Filter, filters, func(f Filter) ([]Filter, bool) {
+		and, ok := f.(*FilterAND)
+		if !ok {
+			return nil, false
+		}
+		return and.Filters, true
+	}, func(filters []Filter) Filter {
+		return &FilterAND{Filters: filters}
+	})
+	return b
+}
+
+// Or matches the documents of either the current filter or one of the filters
+func (b *Builder) Or(filters ...Filter) *Builder {
+	b.mq.Filter = combine(b.mq.Filter, filters, func(f Filter) ([]Filter, bool) {
+		or, ok := f.(*FilterOR)
+		if !ok {
+			return nil, false
+		}
+		return or.Filters, true
+	}, func(filters []Filter) Filter {
+		return &FilterOR{Filters: filters}
+	})
+	return b
+}
+
+// combine appends the filters to the current one, extending the current AND (OR)
+// rather than nesting it. The filters of the caller are not modified.
+func combine(current Filter, filters []Filter, entries func(Filter) ([]Filter, bool), join func([]Filter) Filter) Filter {
+	all := []Filter{}
+	if current != nil {
+		if nested, ok := entries(current); ok {
+			all = append(all, nested...)
+		} else {
+			all = append(all, current)
+		}
+	}
+	all = append(all, filters...)
+	switch len(all) {
+	case 0:
+		return nil
+	case 1:
+		return all[0]
+	default:
+		return join(all)
+	}
+}
+
+// OrderBy appends a sort key with the order Asc or Desc
+func (b *Builder) OrderBy(key, order string) *Builder {
+	b.mq.Sort = append(b.mq.Sort, Sorting{Key: key, Order: order})
+	return b
+}
+
+// Select sets the fields to return
+func (b *Builder) Select(fields ...string) *Builder {
+	b.mq.Select = SelectFields(append(b.mq.Select, fields...))
+	return b
+}
+
+// Limit sets the page size
+func (b *Builder) Limit(limit int) *Builder {
+	b.mq.Page.Limit = limit
+	return b
+}
+
+// Token sets the pagination token of the first page
+func (b *Builder) Token(token string) *Builder {
+	b.mq.Page.Token = token
+	return b
+}
+
+// WithTotal counts the matching documents along with the first page
+func (b *Builder) WithTotal() *Builder {
+	b.mq.Page.WithTotal = true
+	return b
+}
+
+// GroupBy sets the group keys of the aggregation
+func (b *Builder) GroupBy(keys ...string) *Builder {
+	b.aggregation().GroupBy = append(b.aggregation().GroupBy, keys...)
+	return b
+}
+
+// Aggregate appends the aggregate functions, see Count, Sum, Avg, Min and Max
+func (b *Builder) Aggregate(functions ...Aggregate) *Builder {
+	b.aggregation().Functions = append(b.aggregation().Functions, functions...)
+	return b
+}
+
+func (b *Builder) aggregation() *Aggregation {
+	if b.mq.Aggregate == nil {
+		b.mq.Aggregate = &Aggregation{}
+	}
+	return b.mq.Aggregate
+}
+
+// Build validates the query and returns it. The query does not share its slices
+// with the builder, which may be extended further.
+func (b *Builder) Build() (*MidQuery, error) {
+	mq := b.mq
+	mq.Sort = append([]Sorting(nil), b.mq.Sort...)
+	mq.Select = append([]string(nil), b.mq.Select...)
+	if b.mq.Aggregate != nil {
+		mq.Aggregate = &Aggregation{
+			GroupBy:   append([]string(nil), b.mq.Aggregate.GroupBy...),
+			Functions: append([]Aggregate(nil), b.mq.Aggregate.Functions...),
+		}
+	}
+	if err := mq.Validate(); err != nil {
+		return nil, err
+	}
+	return &mq, nil
+}
+
+// literal converts the Go values, which have a query literal of their own
+func literal(v interface{}) interface{} {
+	if t, ok := v.(time.Time); ok {
+		return Date{Time: t.UTC()}
+	}
+	return v
+}
+
+func literals(vals []interface{}) []interface{} {
+	ret := make([]interface{}, len(vals))
+	for i, v := range vals {
+		ret[i] = literal(v)
+	}
+	return ret
+}
+
+// Eq matches the documents with the value of the key equal to val.
+// The values of all filters are scalars; time.Time values are dates.
+func Eq(key string, val interface{}) Filter {
+	return &FilterEQ{Key: key, Val: literal(val)}
+}
+
+func Ne(key string, val interface{}) Filter {
+	return &FilterNE{Key: key, Val: literal(val)}
+}
+
+func Gt(key string, val interface{}) Filter {
+	return &FilterGT{Key: key, Val: literal(val)}
+}
+
+func Gte(key string, val interface{}) Filter {
+	return &FilterGTE{Key: key, Val: literal(val)}
+}
+
+func Lt(key string, val interface{}) Filter {
+	return &FilterLT{Key: key, Val: literal(val)}
+}
+
+func Lte(key string, val interface{}) Filter {
+	return &FilterLTE{Key: key, Val: literal(val)}
+}
+
+func In(key string, vals ...interface{}) Filter {
+	return &FilterIN{Key: key, Vals: literals(vals)}
+}
+
+// Between matches the values within the inclusive range; see FilterBETWEEN for exclusive bounds
+func Between(key string, lower, upper interface{}) Filter {
+	return &FilterBETWEEN{Key: key, Lower: literal(lower), Upper: literal(upper), LowerInclusive: true, UpperInclusive: true}
+}
+
+func StartsWith(key, prefix string) Filter {
+	return &FilterSTARTSWITH{Key: key, Val: prefix}
+}
+
+func Contains(key, substr string) Filter {
+	return &FilterCONTAINS{Key: key, Val: substr}
+}
+
+func Regex(key, pattern string) Filter {
+	return &FilterREGEX{Key: key, Pattern: pattern}
+}
+
+func Exists(key string) Filter {
+	return &FilterEXISTS{Key: key}
+}
+
+func IsNull(key string) Filter {
+	return &FilterISNULL{Key: key}
+}
+
+func ArrayContains(key string, val interface{}) Filter {
+	return &FilterARRAYCONTAINS{Key: key, Val: literal(val)}
+}
+
+// Any matches the documents with an element of the array satisfying the filter
+func Any(key string, filter Filter) Filter {
+	return &FilterANY{Key: key, Filter: filter}
+}
+
+func And(filters ...Filter) Filter {
+	return &FilterAND{Filters: filters}
+}
+
+func Or(filters ...Filter) Filter {
+	return &FilterOR{Filters: filters}
+}
+
+func Not(filter Filter) Filter {
+	return &FilterNOT{Filter: filter}
+}
+
+// Count counts the documents of the group; the aliases of the functions
+// default to e.g. "count" and "sum_person_code"
+func Count() Aggregate {
+	return Aggregate{Op: COUNT}
+}
+
+func Sum(key string) Aggregate {
+	return Aggregate{Op: SUM, Key: key}
+}
+
+func Avg(key string) Aggregate {
+	return Aggregate{Op: AVG, Key: key}
+}
+
+func Min(key string) Aggregate {
+	return Aggregate{Op: MIN, Key: key}
+}
+
+func Max(key string) Aggregate {
+	return Aggregate{Op: MAX, Key: key}
+}
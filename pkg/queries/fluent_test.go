@@ -0,0 +1,95 @@
+package queries
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilder(t *testing.T) {
+	tests := []struct {
+		builder *Builder
+		json    string
+	}{
+		{
+			builder: Where(),
+			json:    `{}`,
+		},
+		{
+			builder: Where(Eq("state", "CA")).And(In("person.org", "A", "B")).OrderBy("state", Desc).Limit(10),
+			json:    `{"filter": {"AND": [{"EQ": {"state": "CA"}}, {"IN": {"person.org": ["A", "B"]}}]}, "sort": [{"key": "state", "order": "DESC"}], "pagination": {"limit": 10}}`,
+		},
+		{
+			// AND and OR are extended rather than nested
+			builder: Where(Eq("person.org", "A"), Ne("state", "CA")).And(Exists("zip")).Or(Between("person.code", 1003, 1005)).Or(IsNull("city")),
+			json: `{"filter": {"OR": [{"AND": [{"EQ": {"person.org": "A"}}, {"NE": {"state": "CA"}}, {"EXISTS": "zip"}]}, ` +
+				`{"BETWEEN": {"person.code": {"gte": 1003, "lte": 1005}}}, {"ISNULL": "city"}]}}`,
+		},
+		{
+			builder: Where(Not(Or(StartsWith("person.name", "J"), Contains("city", "San"), Regex("city", "^Los ")))).
+				And(Any("addresses", And(Gte("zip", 98000), Lt("zip", 99000)))).
+				OrderBy("person.name", Asc).Select("person", "person.name", "state").Token("abc").WithTotal(),
+			json: `{"filter": {"AND": [{"NOT": {"OR": [{"STARTSWITH": {"person.name": "J"}}, {"CONTAINS": {"city": "San"}}, {"REGEX": {"city": "^Los "}}]}}, ` +
+				`{"ANY": {"addresses": {"AND": [{"GTE": {"zip": 98000}}, {"LT": {"zip": 99000}}]}}}]}, ` +
+				`"sort": [{"key": "person.name", "order": "ASC"}], "select": ["person", "state"], "pagination": {"token": "abc", "withTotal": true}}`,
+		},
+		{
+			builder: Where(Gt("joined", time.Date(2021, 6, 1, 2, 0, 0, 0, time.FixedZone("CEST", 2*3600))), ArrayContains("tags", "vip")),
+			json:    `{"filter": {"AND": [{"GT": {"joined": {"$date": "2021-06-01T00:00:00Z"}}}, {"ARRAY_CONTAINS": {"tags": "vip"}}]}}`,
+		},
+		{
+			builder: Where(Lte("person.code", 1006)).GroupBy("state").Aggregate(Count(), Sum("person.code"), Avg("person.code"), Min("city"), Max("city")).OrderBy("count", Desc),
+			json: `{"filter": {"LTE": {"person.code": 1006}}, "sort": [{"key": "count", "order": "DESC"}], "aggregate": {"groupBy": ["state"], "functions": [` +
+				`{"op": "COUNT"}, {"op": "SUM", "key": "person.code"}, {"op": "AVG", "key": "person.code"}, {"op": "MIN", "key": "city"}, {"op": "MAX", "key": "city"}]}}`,
+		},
+	}
+	for _, test := range tests {
+		mq, err := test.builder.Build()
+		require.NoError(t, err)
+		var expected MidQuery
+		require.NoError(t, json.Unmarshal([]byte(test.json), &expected))
+
+		// the built values are Go types, compare the canonical JSON
+		jdata, err := json.Marshal(mq)
+		require.NoError(t, err)
+		edata, err := json.Marshal(&expected)
+		require.NoError(t, err)
+		assert.Equal(t, string(edata), string(jdata))
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	_, err := Where(Eq("state", "CA")).And(Or(Eq("city", "Seattle")), Eq("", 1)).Build()
+	assert.EqualError(t, err, "/filter/AND/1/OR: OR filter must contain at least two entries")
+
+	_, err = Where(In("state", "CA", []string{"WA"})).Build()
+	assert.EqualError(t, err, "/filter/IN: IN filter has unsupported value type []string")
+
+	_, err = Where(In("state")).Build()
+	assert.EqualError(t, err, "/filter/IN/state: IN filter value must not be empty")
+
+	_, err = Where().OrderBy("state", "desc").Build()
+	assert.EqualError(t, err, `/sort/0/order: sort order must be ASC or DESC, got "desc"`)
+
+	_, err = Where().Limit(-1).Build()
+	assert.EqualError(t, err, "/pagination/limit: limit must not be negative")
+
+	_, err = Where().GroupBy("state").Build()
+	assert.EqualError(t, err, `/aggregate/functions: "aggregate" must contain at least one function`)
+}
+
+func TestBuilderReuse(t *testing.T) {
+	base := Where(Eq("state", "CA")).OrderBy("city", Asc)
+	first, err := base.Build()
+	require.NoError(t, err)
+	second, err := base.OrderBy("person.name", Desc).Or(Eq("state", "WA")).Build()
+	require.NoError(t, err)
+
+	assert.Equal(t, []Sorting{{Key: "city", Order: ASC}}, first.Sort)
+	assert.Equal(t, &FilterEQ{Key: "state", Val: "CA"}, first.Filter)
+	assert.Len(t, second.Sort, 2)
+	assert.IsType(t, &FilterOR{}, second.Filter)
+}
@@ -0,0 +1,123 @@
+package queries
+
+import (
+	"encoding/json"
+)
+
+// MarshalJSON writes the query in the canonical form accepted by UnmarshalJSON,
+// omitting the empty clauses
+func (q MidQuery) MarshalJSON() ([]byte, error) {
+	var page *Pagination
+	if q.Page != (Pagination{}) {
+		page = &q.Page
+	}
+	return json.Marshal(&struct {
+		Filter    Filter       `json:"filter,omitempty"`
+		Sort      []Sorting    `json:"sort,omitempty"`
+		Select    []string     `json:"select,omitempty"`
+		Aggregate *Aggregation `json:"aggregate,omitempty"`
+		Page      *Pagination  `json:"pagination,omitempty"`
+	}{
+		Filter:    q.Filter,
+		Sort:      q.Sort,
+		Select:    q.Select,
+		Aggregate: q.Aggregate,
+		Page:      page,
+	})
+}
+
+// marshalUnit writes the filter unit {"OP": body}, with the ignoreCase flag if set
+func marshalUnit(op string, body interface{}, ignoreCase bool) ([]byte, error) {
+	unit := map[string]interface{}{op: body}
+	if ignoreCase {
+		unit[IGNORECASE] = true
+	}
+	return json.Marshal(unit)
+}
+
+func keyValue(key string, val interface{}) map[string]interface{} {
+	return map[string]interface{}{key: val}
+}
+
+func (f *FilterEQ) MarshalJSON() ([]byte, error) {
+	return marshalUnit("EQ", keyValue(f.Key, f.Val), f.IgnoreCase)
+}
+
+func (f *FilterNE) MarshalJSON() ([]byte, error) {
+	return marshalUnit("NE", keyValue(f.Key, f.Val), false)
+}
+
+func (f *FilterGT) MarshalJSON() ([]byte, error) {
+	return marshalUnit("GT", keyValue(f.Key, f.Val), false)
+}
+
+func (f *FilterGTE) MarshalJSON() ([]byte, error) {
+	return marshalUnit("GTE", keyValue(f.Key, f.Val), false)
+}
+
+func (f *FilterLT) MarshalJSON() ([]byte, error) {
+	return marshalUnit("LT", keyValue(f.Key, f.Val), false)
+}
+
+func (f *FilterLTE) MarshalJSON() ([]byte, error) {
+	return marshalUnit("LTE", keyValue(f.Key, f.Val), false)
+}
+
+func (f *FilterIN) MarshalJSON() ([]byte, error) {
+	vals := f.Vals
+	if vals == nil {
+		vals = []interface{}{}
+	}
+	return marshalUnit("IN", keyValue(f.Key, vals), false)
+}
+
+func (f *FilterBETWEEN) MarshalJSON() ([]byte, error) {
+	lower, upper := "gt", "lt"
+	if f.LowerInclusive {
+		lower = "gte"
+	}
+	if f.UpperInclusive {
+		upper = "lte"
+	}
+	return marshalUnit("BETWEEN", keyValue(f.Key, map[string]interface{}{lower: f.Lower, upper: f.Upper}), false)
+}
+
+func (f *FilterSTARTSWITH) MarshalJSON() ([]byte, error) {
+	return marshalUnit("STARTSWITH", keyValue(f.Key, f.Val), f.IgnoreCase)
+}
+
+func (f *FilterCONTAINS) MarshalJSON() ([]byte, error) {
+	return marshalUnit("CONTAINS", keyValue(f.Key, f.Val), f.IgnoreCase)
+}
+
+func (f *FilterREGEX) MarshalJSON() ([]byte, error) {
+	return marshalUnit("REGEX", keyValue(f.Key, f.Pattern), f.IgnoreCase)
+}
+
+func (f *FilterEXISTS) MarshalJSON() ([]byte, error) {
+	return marshalUnit("EXISTS", f.Key, false)
+}
+
+func (f *FilterISNULL) MarshalJSON() ([]byte, error) {
+	return marshalUnit("ISNULL", f.Key, false)
+}
+
+func (f *FilterARRAYCONTAINS) MarshalJSON() ([]byte, error) {
+	return marshalUnit("ARRAY_CONTAINS", keyValue(f.Key, f.Val), false)
+}
+
+func (f *FilterANY) MarshalJSON() ([]byte, error) {
+	return marshalUnit("ANY", keyValue(f.Key, f.Filter), false)
+}
+
+func (f *FilterAND) MarshalJSON() ([]byte, error) {
+	return marshalUnit("AND", f.Filters, false)
+}
+
+func (f *FilterOR) MarshalJSON() ([]byte, error) {
+	return marshalUnit("OR", f.Filters, false)
+}
+
+func (f *FilterNOT) MarshalJSON() ([]byte, error) {
+	return marshalUnit("NOT", f.Filter, false)
+}
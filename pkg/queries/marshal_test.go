@@ -0,0 +1,100 @@
+package queries
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	// resolve the relative dates of both parses to the same time
+	defer func(f func() time.Time) { now = f }(now)
+	now = func() time.Time { return time.Date(2021, 6, 15, 14, 0, 0, 0, time.UTC) }
+
+	files, err := filepath.Glob("../../tests/q*.json")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, fname := range files {
+		t.Run(filepath.Base(fname), func(t *testing.T) {
+			data, err := os.ReadFile(fname)
+			require.NoError(t, err)
+			var mq MidQuery
+			require.NoError(t, json.Unmarshal(data, &mq))
+
+			jdata, err := json.Marshal(&mq)
+			require.NoError(t, err)
+			var other MidQuery
+			require.NoError(t, json.Unmarshal(jdata, &other), string(jdata))
+			assert.Equal(t, mq, other, string(jdata))
+
+			// the canonical form is stable
+			again, err := json.Marshal(other)
+			require.NoError(t, err)
+			assert.Equal(t, string(jdata), string(again))
+		})
+	}
+}
+
+func TestMarshalQuery(t *testing.T) {
+	tests := []struct {
+		query MidQuery
+		json  string
+	}{
+		{
+			query: MidQuery{},
+			json:  `{}`,
+		},
+		{
+			query: MidQuery{
+				Filter: &FilterAND{Filters: []Filter{
+					&FilterEQ{Key: "state", Val: "ca", IgnoreCase: true},
+					&FilterNOT{Filter: &FilterIN{Key: "person.code", Vals: []interface{}{1001, 1002}}},
+				}},
+				Sort: []Sorting{{Key: "state", Order: DESC}, {Key: "city"}},
+				Page: Pagination{Limit: 2},
+			},
+			json: `{"filter":{"AND":[{"EQ":{"state":"ca"},"ignoreCase":true},{"NOT":{"IN":{"person.code":[1001,1002]}}}]},` +
+				`"sort":[{"key":"state","order":"DESC"},{"key":"city"}],"pagination":{"limit":2}}`,
+		},
+		{
+			query: MidQuery{
+				Filter: &FilterOR{Filters: []Filter{
+					&FilterBETWEEN{Key: "person.code", Lower: 1003, Upper: 1006, LowerInclusive: true},
+					&FilterANY{Key: "addresses", Filter: &FilterEXISTS{Key: "zip"}},
+				}},
+				Select: []string{"person.name"},
+			},
+			json: `{"filter":{"OR":[{"BETWEEN":{"person.code":{"gte":1003,"lt":1006}}},{"ANY":{"addresses":{"EXISTS":"zip"}}}]},"select":["person.name"]}`,
+		},
+		{
+			query: MidQuery{
+				Filter: &FilterGTE{Key: "joined", Val: Date{Time: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}},
+				Page:   Pagination{Token: "abc", WithTotal: true},
+			},
+			json: `{"filter":{"GTE":{"joined":{"$date":"2021-06-01T00:00:00Z"}}},"pagination":{"limit":0,"token":"abc","withTotal":true}}`,
+		},
+		{
+			query: MidQuery{
+				Filter: &FilterLT{Key: "joined", Val: Date{Time: time.Now(), Expr: "now-7d"}},
+				Aggregate: &Aggregation{
+					GroupBy:   []string{"state"},
+					Functions: []Aggregate{{Op: COUNT, As: "count"}},
+				},
+			},
+			json: `{"filter":{"LT":{"joined":{"$date":"now-7d"}}},"aggregate":{"groupBy":["state"],"functions":[{"op":"COUNT","as":"count"}]}}`,
+		},
+	}
+	for _, test := range tests {
+		jdata, err := json.Marshal(test.query)
+		require.NoError(t, err)
+		assert.Equal(t, test.json, string(jdata))
+
+		var mq MidQuery
+		assert.NoError(t, json.Unmarshal(jdata, &mq))
+	}
+}
@@ -0,0 +1,84 @@
+package queries
+
+import (
+	"context"
+)
+
+// Pager fetches the results of a built query page by page. The first page starts
+// at the pagination token of the MidQuery, so a client can resume a query from
+// the token it was handed earlier. With a codec, the tokens exchanged with the
+// client are opaque; otherwise they are the raw backend cursors.
+type Pager struct {
+	db      DbInterface
+	visitor Visitor
+	mq      *MidQuery
+	codec   *TokenCodec
+
+	token    string
+	done     bool
+	total    int64
+	hasTotal bool
+}
+
+// NewPager expects the visitor to be already finalized with the MidQuery (see QueryBuilder)
+func NewPager(db DbInterface, visitor Visitor, mq *MidQuery, codec *TokenCodec) *Pager {
+	return &Pager{
+		db:      db,
+		visitor: visitor,
+		mq:      mq,
+		codec:   codec,
+		token:   mq.Page.Token,
+	}
+}
+
+// Next returns the next page of results
+func (p *Pager) Next(ctx context.Context) ([]interface{}, error) {
+	if p.done {
+		return []interface{}{}, nil
+	}
+	cursor := p.token
+	if p.codec != nil {
+		var err error
+		if cursor, err = p.codec.Decode(p.mq, p.token); err != nil {
+			return nil, err
+		}
+	}
+	if p.mq.Page.WithTotal && !p.hasTotal {
+		total, err := p.db.Count(ctx, p.visitor)
+		if err != nil {
+			return nil, err
+		}
+		p.total, p.hasTotal = total, true
+	}
+	ret, cursor, err := p.db.RunQuery(ctx, p.visitor, cursor)
+	if err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		cursor = ""
+	}
+	p.token = cursor
+	if p.codec != nil {
+		if p.token, err = p.codec.Encode(p.mq, cursor); err != nil {
+			return nil, err
+		}
+	}
+	p.done = len(p.token) == 0
+	return ret, nil
+}
+
+// Token returns the token of the next page; it is empty when there are no more pages
+func (p *Pager) Token() string {
+	return p.token
+}
+
+// Total returns the number of documents matching the query. It is available
+// after the first page, if the query asks for it with "withTotal".
+func (p *Pager) Total() (int64, bool) {
+	return p.total, p.hasTotal
+}
+
+// Done reports whether all pages have been fetched
+func (p *Pager) Done() bool {
+	return p.done
+}
@@ -0,0 +1,116 @@
+package queries
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pagedDB returns the numbers 0..size-1 in pages of two, using the offset as the cursor
+type pagedDB struct {
+	size    int
+	cursors []string
+	counts  int
+}
+
+func (db *pagedDB) Populate(context.Context, []interface{}) error { return nil }
+func (db *pagedDB) Disconnect(context.Context) error              { return nil }
+
+func (db *pagedDB) Aggregate(context.Context, interface{}) ([]interface{}, error) {
+	return nil, nil
+}
+
+func (db *pagedDB) Count(context.Context, interface{}) (int64, error) {
+	db.counts++
+	return int64(db.size), nil
+}
+
+func (db *pagedDB) RunQuery(ctx context.Context, q interface{}, cursor string) ([]interface{}, string, error) {
+	db.cursors = append(db.cursors, cursor)
+	start := 0
+	if len(cursor) != 0 {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	ret := []interface{}{}
+	for i := start; i < start+2 && i < db.size; i++ {
+		ret = append(ret, i)
+	}
+	if start+2 >= db.size {
+		return ret, "", nil
+	}
+	return ret, strconv.Itoa(start + 2), nil
+}
+
+func drain(t *testing.T, pager *Pager) []interface{} {
+	all := []interface{}{}
+	for !pager.Done() {
+		ret, err := pager.Next(context.Background())
+		require.NoError(t, err)
+		all = append(all, ret...)
+	}
+	return all
+}
+
+func TestPager(t *testing.T) {
+	ctx := context.Background()
+	mq := &MidQuery{Filter: &FilterEQ{Key: "state", Val: "CA"}}
+
+	// raw cursors
+	db := &pagedDB{size: 5}
+	pager := NewPager(db, nil, mq, nil)
+	assert.Equal(t, []interface{}{0, 1, 2, 3, 4}, drain(t, pager))
+	assert.Equal(t, []string{"", "2", "4"}, db.cursors)
+	assert.Empty(t, pager.Token())
+
+	// resume from the token of the query
+	db = &pagedDB{size: 5}
+	resumed := *mq
+	resumed.Page.Token = "2"
+	assert.Equal(t, []interface{}{2, 3, 4}, drain(t, NewPager(db, nil, &resumed, nil)))
+	assert.Equal(t, []string{"2", "4"}, db.cursors)
+
+	// opaque tokens: fetch a single page and resume with the returned token
+	codec := NewTokenCodec("test", []byte("secret"))
+	db = &pagedDB{size: 5}
+	pager = NewPager(db, nil, mq, codec)
+	ret, err := pager.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{0, 1}, ret)
+	assert.False(t, pager.Done())
+	assert.NotEqual(t, "2", pager.Token())
+
+	resumed.Page.Token = pager.Token()
+	assert.Equal(t, []interface{}{2, 3, 4}, drain(t, NewPager(db, nil, &resumed, codec)))
+	assert.Equal(t, []string{"", "2", "4"}, db.cursors)
+
+	// tokens are bound to the query
+	other := &MidQuery{Filter: &FilterEQ{Key: "state", Val: "WA"}}
+	other.Page.Token = resumed.Page.Token
+	_, err = NewPager(db, nil, other, codec).Next(ctx)
+	assert.EqualError(t, err, "invalid pagination token: token belongs to another query")
+
+	// the total is counted once, along with the first page
+	db = &pagedDB{size: 5}
+	pager = NewPager(db, nil, mq, nil)
+	drain(t, pager)
+	_, ok := pager.Total()
+	assert.False(t, ok)
+	assert.Equal(t, 0, db.counts)
+
+	counted := *mq
+	counted.Page.WithTotal = true
+	pager = NewPager(db, nil, &counted, nil)
+	_, err = pager.Next(ctx)
+	require.NoError(t, err)
+	total, ok := pager.Total()
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), total)
+	drain(t, pager)
+	assert.Equal(t, 1, db.counts)
+}
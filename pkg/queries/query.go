@@ -1,8 +1,10 @@
 package queries
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 )
 
 type SortingOrder int
@@ -11,14 +13,22 @@ const (
 	FILTER = "filter"
 	SORT   = "sort"
 	PAGE   = "pagination"
+	SELECT = "select"
 	ASC    = "ASC"
 	DESC   = "DESC"
 )
 
+// DbInterface is implemented by the backends. Every operation is bound by the context;
+// the backends additionally apply the timeouts from their config (see Timeouts).
 type DbInterface interface {
-	Populate([]interface{}) error
-	RunQuery(interface{}, string) ([]interface{}, string, error)
-	Disconnect() error
+	Populate(context.Context, []interface{}) error
+	RunQuery(context.Context, interface{}, string) ([]interface{}, string, error)
+	// Aggregate returns all result rows of a query with the aggregation section
+	Aggregate(context.Context, interface{}) ([]interface{}, error)
+	// Count returns the number of documents matching the filter of the query,
+	// regardless of its pagination
+	Count(context.Context, interface{}) (int64, error)
+	Disconnect(context.Context) error
 }
 
 type Sorting struct {
@@ -29,56 +39,161 @@ type Sorting struct {
 type Pagination struct {
 	Limit int    `json:"limit"`
 	Token string `json:"token,omitempty"`
+	// count the matching documents along with the first page
+	WithTotal bool `json:"withTotal,omitempty"`
 }
 
 type MidQuery struct {
 	Filters map[string]interface{} `json:"filter"`
 	Sort    []Sorting              `json:"sort"`
 	Page    Pagination             `json:"page"`
+	// fields to return; whole documents when empty
+	Select []string `json:"select"`
+	// group by and aggregate functions
+	Aggregate *Aggregation `json:"aggregate"`
 
 	// derived from Filters
 	Filter Filter
 }
 
+// UnmarshalJSON parses and validates the query. Unknown keys are rejected at every
+// level and the errors are located by a JSON pointer, e.g. "/filter/OR/1/AND/0/IN: ...".
 func (q *MidQuery) UnmarshalJSON(data []byte) error {
 	var m map[string]interface{}
 	err := json.Unmarshal(data, &m)
 	if err != nil {
 		return err
 	}
+	if err = checkKeys(m, FILTER, SORT, SELECT, AGGREGATE, PAGE); err != nil {
+		return err
+	}
 	if elem, ok := m[FILTER]; ok {
 		q.Filter, err = parseFilter(elem)
 		if err != nil {
-			return err
+			return atPath(FILTER, err)
+		}
+		if q.Filter == nil {
+			return atPath(FILTER, fmt.Errorf("%q must contain a filter", FILTER))
 		}
 	}
 	// setting sorting
 	if elem, ok := m[SORT]; ok {
-		arr, ok := elem.([]interface{})
-		if !ok {
-			return fmt.Errorf("%q must be an array", SORT)
+		if q.Sort, err = parseSort(elem); err != nil {
+			return atPath(SORT, err)
 		}
-		jdata, err := json.Marshal(arr)
-		if err != nil {
-			return err
+	}
+	// setting projection
+	if elem, ok := m[SELECT]; ok {
+		if q.Select, err = parseSelect(elem); err != nil {
+			return atPath(SELECT, err)
 		}
-		if err = json.Unmarshal(jdata, &q.Sort); err != nil {
-			return err
+	}
+	// setting aggregation
+	if elem, ok := m[AGGREGATE]; ok {
+		if q.Aggregate, err = parseAggregation(elem); err != nil {
+			return atPath(AGGREGATE, err)
 		}
 	}
 	// setting pagination
 	if elem, ok := m[PAGE]; ok {
-		page, ok := elem.(map[string]interface{})
+		if err = q.Page.parse(elem); err != nil {
+			return atPath(PAGE, err)
+		}
+	}
+	return q.Validate()
+}
+
+func parseSort(obj interface{}) ([]Sorting, error) {
+	arr, ok := obj.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%q must be an array", SORT)
+	}
+	ret := make([]Sorting, len(arr))
+	for i, entry := range arr {
+		m, ok := entry.(map[string]interface{})
 		if !ok {
-			return fmt.Errorf("%q must be a map", PAGE)
+			return nil, atIndex(i, fmt.Errorf("sort entry must be a map"))
 		}
-		jdata, err := json.Marshal(page)
-		if err != nil {
-			return err
+		if err := checkKeys(m, "key", "order"); err != nil {
+			return nil, atIndex(i, err)
+		}
+		if ret[i].Key, ok = m["key"].(string); !ok {
+			return nil, atIndex(i, atPath("key", fmt.Errorf("sort key must be a string")))
+		}
+		if order, found := m["order"]; found {
+			if ret[i].Order, ok = order.(string); !ok {
+				return nil, atIndex(i, atPath("order", fmt.Errorf("sort order must be a string")))
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (p *Pagination) parse(obj interface{}) error {
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%q must be a map", PAGE)
+	}
+	if err := checkKeys(m, "limit", "token", "withTotal"); err != nil {
+		return err
+	}
+	if v, found := m["limit"]; found {
+		limit, ok := v.(float64)
+		if !ok || limit != float64(int(limit)) {
+			return atPath("limit", fmt.Errorf("limit must be an integer"))
 		}
-		if err = json.Unmarshal(jdata, &q.Page); err != nil {
-			return err
+		p.Limit = int(limit)
+	}
+	if v, found := m["token"]; found {
+		if p.Token, ok = v.(string); !ok {
+			return atPath("token", fmt.Errorf("token must be a string"))
+		}
+	}
+	if v, found := m["withTotal"]; found {
+		if p.WithTotal, ok = v.(bool); !ok {
+			return atPath("withTotal", fmt.Errorf("withTotal must be a boolean"))
 		}
 	}
 	return nil
 }
+
+func parseSelect(obj interface{}) ([]string, error) {
+	arr, ok := obj.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%q must be an array", SELECT)
+	}
+	fields := make([]string, len(arr))
+	for i, entry := range arr {
+		field, ok := entry.(string)
+		if !ok || len(field) == 0 {
+			return nil, atIndex(i, fmt.Errorf("%q must contain non-empty field names", SELECT))
+		}
+		fields[i] = field
+	}
+	return SelectFields(fields), nil
+}
+
+// SelectFields removes duplicate fields and the fields covered by a selected
+// parent (e.g. "person.name" when "person" is selected), preserving the order
+func SelectFields(fields []string) []string {
+	ret := []string{}
+	for _, field := range fields {
+		covered := false
+		for _, other := range fields {
+			if strings.HasPrefix(field, other+".") {
+				covered = true
+				break
+			}
+		}
+		for _, prev := range ret {
+			if prev == field {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			ret = append(ret, field)
+		}
+	}
+	return ret
+}
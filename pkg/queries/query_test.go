@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -61,6 +62,196 @@ func TestQuery(t *testing.T) {
 				},
 			},
 		},
+		{
+			input: "../../tests/q5.json",
+			query: MidQuery{
+				Filters: nil,
+				Sort: []Sorting{
+					{Key: "city", Order: ""},
+				},
+				Page: Pagination{Limit: 0, Token: ""},
+				Filter: &FilterAND{
+					Filters: []Filter{
+						&FilterNE{Key: "state", Val: "CA"},
+						&FilterGTE{Key: "city", Val: "P"},
+						&FilterLT{Key: "person.name", Val: "M"},
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q6.json",
+			query: MidQuery{
+				Filters: nil,
+				Sort:    nil,
+				Page:    Pagination{Limit: 3, Token: ""},
+				Filter: &FilterOR{
+					Filters: []Filter{
+						&FilterGT{Key: "person.org", Val: "B"},
+						&FilterLTE{Key: "state", Val: "CA"},
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q7.json",
+			query: MidQuery{
+				Filters: nil,
+				Sort: []Sorting{
+					{Key: "person.name", Order: ""},
+				},
+				Page: Pagination{Limit: 0, Token: ""},
+				Filter: &FilterNOT{
+					Filter: &FilterAND{
+						Filters: []Filter{
+							&FilterEQ{Key: "person.org", Val: "A"},
+							&FilterEQ{Key: "state", Val: "WA"},
+						},
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q8.json",
+			query: MidQuery{
+				Filters: nil,
+				Sort: []Sorting{
+					{Key: "person.code", Order: "DESC"},
+				},
+				Page: Pagination{Limit: 0, Token: ""},
+				Filter: &FilterAND{
+					Filters: []Filter{
+						&FilterGTE{Key: "person.code", Val: float64(1002)},
+						&FilterLT{Key: "person.code", Val: 1008.5},
+						&FilterIN{Key: "person.code", Vals: []interface{}{float64(1003), float64(1005), float64(1007)}},
+						&FilterNE{Key: "retired", Val: true},
+						&FilterNE{Key: "state", Val: nil},
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q9.json",
+			query: MidQuery{
+				Filters: nil,
+				Sort: []Sorting{
+					{Key: "person.code", Order: "DESC"},
+				},
+				Page:   Pagination{Limit: 2, Token: ""},
+				Select: []string{"person.name", "state"},
+				Filter: &FilterEQ{Key: "person.org", Val: "A"},
+			},
+		},
+		{
+			input: "../../tests/q10.json",
+			query: MidQuery{
+				Filters: nil,
+				Sort: []Sorting{
+					{Key: "count", Order: "DESC"},
+					{Key: "state", Order: ""},
+				},
+				Page:   Pagination{Limit: 0, Token: ""},
+				Filter: &FilterNE{Key: "person.org", Val: "C"},
+				Aggregate: &Aggregation{
+					GroupBy: []string{"state"},
+					Functions: []Aggregate{
+						{Op: COUNT, As: "count"},
+						{Op: SUM, Key: "person.code", As: "sum_person_code"},
+						{Op: MAX, Key: "person.name", As: "last"},
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q11.json",
+			query: MidQuery{
+				Filters: nil,
+				Sort: []Sorting{
+					{Key: "person.name", Order: ""},
+				},
+				Page: Pagination{Limit: 0, Token: ""},
+				Filter: &FilterOR{
+					Filters: []Filter{
+						&FilterSTARTSWITH{Key: "person.name", Val: "j", IgnoreCase: true},
+						&FilterREGEX{Key: "city", Pattern: "^San "},
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q12.json",
+			query: MidQuery{
+				Filters: nil,
+				Sort: []Sorting{
+					{Key: "person.code", Order: "DESC"},
+				},
+				Page: Pagination{Limit: 3, Token: ""},
+				Filter: &FilterAND{
+					Filters: []Filter{
+						&FilterEXISTS{Key: "person.code"},
+						&FilterNOT{Filter: &FilterISNULL{Key: "state"}},
+						&FilterNOT{Filter: &FilterEXISTS{Key: "zip"}},
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q13.json",
+			query: MidQuery{
+				Filters: nil,
+				Sort:    nil,
+				Page:    Pagination{Limit: 0, Token: ""},
+				Filter: &FilterOR{
+					Filters: []Filter{
+						&FilterARRAYCONTAINS{Key: "tags", Val: "vip"},
+						&FilterANY{
+							Key: "addresses",
+							Filter: &FilterAND{
+								Filters: []Filter{
+									&FilterEQ{Key: "city", Val: "Seattle"},
+									&FilterANY{Key: "phones", Filter: &FilterSTARTSWITH{Key: "number", Val: "+1"}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q14.json",
+			query: MidQuery{
+				Filters: nil,
+				Sort: []Sorting{
+					{Key: "person.code", Order: ""},
+				},
+				Page: Pagination{Limit: 0, Token: ""},
+				Filter: &FilterOR{
+					Filters: []Filter{
+						&FilterBETWEEN{Key: "person.code", Lower: float64(1003), Upper: float64(1006), LowerInclusive: true},
+						&FilterBETWEEN{Key: "person.name", Lower: "L", Upper: "Mike", LowerInclusive: true, UpperInclusive: true},
+					},
+				},
+			},
+		},
+		{
+			input: "../../tests/q15.json",
+			query: MidQuery{
+				Filters: nil,
+				Sort:    nil,
+				Page:    Pagination{Limit: 0, Token: ""},
+				Filter: &FilterAND{
+					Filters: []Filter{
+						&FilterGTE{Key: "joined", Val: Date{Time: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}},
+						&FilterBETWEEN{
+							Key:            "updated",
+							Lower:          Date{Time: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+							Upper:          Date{Time: time.Date(2021, 12, 31, 23, 59, 59, 500000000, time.UTC)},
+							UpperInclusive: true,
+						},
+					},
+				},
+			},
+		},
 	}
 	for _, test := range tests {
 		data, err := os.ReadFile(test.input)
@@ -71,3 +262,245 @@ func TestQuery(t *testing.T) {
 		assert.Equal(t, test.query, mq)
 	}
 }
+
+func TestFilterValues(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{
+			input: `{"filter": {"EQ": {"person.code": 1001}}}`,
+		},
+		{
+			input: `{"filter": {"IN": {"state": ["CA", 1, true, null]}}}`,
+		},
+		{
+			input: `{"filter": {"EQ": {"person": {"name": "Peter"}}}}`,
+			err:   "/filter/EQ: EQ filter has unsupported value type map[string]interface {}",
+		},
+		{
+			input: `{"filter": {"GT": {"person.code": [1001]}}}`,
+			err:   "/filter/GT: GT filter has unsupported value type []interface {}",
+		},
+		{
+			input: `{"filter": {"IN": {"state": ["CA", ["WA"]]}}}`,
+			err:   "/filter/IN: IN filter has unsupported value type []interface {}",
+		},
+		{
+			input: `{"filter": {"EQ": {"state": "ca"}, "ignoreCase": true}}`,
+		},
+		{
+			input: `{"filter": {"CONTAINS": {"city": "an"}, "ignoreCase": false}}`,
+		},
+		{
+			input: `{"filter": {"EQ": {"person.code": 1001}, "ignoreCase": true}}`,
+			err:   `/filter/ignoreCase: "ignoreCase" requires a string value in EQ filter`,
+		},
+		{
+			input: `{"filter": {"GT": {"state": "CA"}, "ignoreCase": true}}`,
+			err:   `/filter/ignoreCase: "ignoreCase" is not supported by GT filter`,
+		},
+		{
+			input: `{"filter": {"EQ": {"state": "CA"}, "ignoreCase": "yes"}}`,
+			err:   `/filter/ignoreCase: "ignoreCase" must be a boolean`,
+		},
+		{
+			input: `{"filter": {"ignoreCase": true}}`,
+			err:   `/filter: "ignoreCase" must be next to a filter`,
+		},
+		{
+			input: `{"filter": {"STARTSWITH": {"person.code": 1}}}`,
+			err:   "/filter/STARTSWITH: STARTSWITH filter value must be a string",
+		},
+		{
+			input: `{"filter": {"REGEX": {"city": "San ("}}}`,
+			err:   "/filter/REGEX: REGEX filter has invalid pattern: error parsing regexp: missing closing ): `San (`",
+		},
+		{
+			input: `{"filter": {"EXISTS": ""}}`,
+			err:   "/filter/EXISTS: EXISTS filter must be a non-empty key",
+		},
+		{
+			input: `{"filter": {"ISNULL": {"zip": true}}}`,
+			err:   "/filter/ISNULL: ISNULL filter must be a non-empty key",
+		},
+		{
+			input: `{"filter": {"ELEMMATCH": {"tags": {"EQ": {"name": "vip"}}}}}`,
+		},
+		{
+			input: `{"filter": {"ARRAY_CONTAINS": {"tags": ["vip"]}}}`,
+			err:   "/filter/ARRAY_CONTAINS: ARRAY_CONTAINS filter has unsupported value type []interface {}",
+		},
+		{
+			input: `{"filter": {"ANY": {"": {"EQ": {"city": "Seattle"}}}}}`,
+			err:   "/filter/ANY: ANY filter must have a non-empty key",
+		},
+		{
+			input: `{"filter": {"ANY": {"addresses": "Seattle"}}}`,
+			err:   "/filter/ANY: ANY filter must contain a filter",
+		},
+		{
+			input: `{"filter": {"ANY": {"addresses": {}}}}`,
+			err:   "/filter/ANY: ANY filter must contain a filter",
+		},
+		{
+			input: `{"filter": {"BETWEEN": {"person.code": {"GT": 1001, "LTE": 1001.5}}}}`,
+		},
+		{
+			input: `{"filter": {"BETWEEN": {"person.code": {"gte": 1001, "lt": "1005"}}}}`,
+			err:   "/filter/BETWEEN: BETWEEN filter has bounds of mismatched types float64 and string",
+		},
+		{
+			input: `{"filter": {"BETWEEN": {"person.code": {"gte": 1005, "lt": 1001}}}}`,
+			err:   "/filter/BETWEEN: BETWEEN filter has lower bound greater than upper bound",
+		},
+		{
+			input: `{"filter": {"BETWEEN": {"person.code": {"gte": 1001}}}}`,
+			err:   "/filter/BETWEEN: BETWEEN filter must have a lower (gt, gte) and an upper (lt, lte) bound",
+		},
+		{
+			input: `{"filter": {"BETWEEN": {"person.code": {"gt": 1001, "gte": 1002, "lt": 1005}}}}`,
+			err:   "/filter/BETWEEN: BETWEEN filter must have a lower (gt, gte) and an upper (lt, lte) bound",
+		},
+		{
+			input: `{"filter": {"BETWEEN": {"person.code": {"gt": 1001, "ne": 1003}}}}`,
+			err:   `/filter/BETWEEN: BETWEEN filter has unsupported bound "ne"`,
+		},
+		{
+			input: `{"filter": {"BETWEEN": {"retired": {"gte": false, "lte": true}}}}`,
+			err:   "/filter/BETWEEN: BETWEEN filter bounds must be numbers, strings or dates, got bool",
+		},
+		{
+			input: `{"filter": {"BETWEEN": {"person.code": [1001, 1005]}}}`,
+			err:   "/filter/BETWEEN: BETWEEN filter range must be a map",
+		},
+		{
+			input: `{"filter": {"IN": {"joined": [{"$date": "2021-06-01"}, {"$date": "now"}]}}}`,
+		},
+		{
+			input: `{"filter": {"EQ": {"joined": {"$date": 1622505600}}}}`,
+			err:   `/filter/EQ: EQ filter has invalid "$date" value: must be a string`,
+		},
+		{
+			input: `{"filter": {"LT": {"joined": {"$date": "yesterday"}}}}`,
+			err:   `/filter/LT: LT filter has invalid date "yesterday": expected RFC 3339 time, YYYY-MM-DD or now[+-]N(s|m|h|d|w)`,
+		},
+		{
+			input: `{"filter": {"EQ": {"joined": {"$date": "2021-06-01", "tz": "UTC"}}}}`,
+			err:   "/filter/EQ: EQ filter has unsupported value type map[string]interface {}",
+		},
+		{
+			input: `{"filter": {"BETWEEN": {"joined": {"gte": {"$date": "2021-06-01"}, "lt": "2021-07-01"}}}}`,
+			err:   "/filter/BETWEEN: BETWEEN filter has bounds of mismatched types queries.Date and string",
+		},
+	}
+	for _, test := range tests {
+		var mq MidQuery
+		err := json.Unmarshal([]byte(test.input), &mq)
+		if len(test.err) == 0 {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, test.err)
+		}
+	}
+}
+
+func TestGetTimeouts(t *testing.T) {
+	timeouts, err := GetTimeouts(map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, Timeouts{Connect: DefaultConnectTimeout, Query: DefaultQueryTimeout, Write: DefaultWriteTimeout}, timeouts)
+
+	timeouts, err = GetTimeouts(map[string]string{"connectTimeout": "5s", "queryTimeout": "1m", "writeTimeout": "0"})
+	assert.NoError(t, err)
+	assert.Equal(t, Timeouts{Connect: 5 * time.Second, Query: time.Minute, Write: 0}, timeouts)
+
+	_, err = GetTimeouts(map[string]string{"queryTimeout": "soon"})
+	assert.EqualError(t, err, `invalid queryTimeout "soon": time: invalid duration "soon"`)
+
+	_, err = GetTimeouts(map[string]string{"writeTimeout": "-1s"})
+	assert.EqualError(t, err, `invalid writeTimeout "-1s": must not be negative`)
+}
+
+func TestSelectFields(t *testing.T) {
+	assert.Equal(t, []string{"person", "state"}, SelectFields([]string{"person.name", "person", "state", "person.org", "state"}))
+	assert.Equal(t, []string{"person.name", "personal"}, SelectFields([]string{"person.name", "personal"}))
+	assert.Equal(t, []string{}, SelectFields(nil))
+
+	var mq MidQuery
+	assert.EqualError(t, json.Unmarshal([]byte(`{"select": "state"}`), &mq), `/select: "select" must be an array`)
+	assert.EqualError(t, json.Unmarshal([]byte(`{"select": ["state", ""]}`), &mq), `/select/1: "select" must contain non-empty field names`)
+}
+
+func TestAggregation(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{
+			input: `{"aggregate": {"groupBy": ["person.org"], "functions": [{"op": "avg", "key": "person.code"}]}}`,
+		},
+		{
+			input: `{"aggregate": ["state"]}`,
+			err:   `/aggregate: "aggregate" must be a map`,
+		},
+		{
+			input: `{"aggregate": {"groupBy": ["state"]}}`,
+			err:   `/aggregate/functions: "aggregate" must contain at least one function`,
+		},
+		{
+			input: `{"aggregate": {"groupBy": [""], "functions": [{"op": "COUNT"}]}}`,
+			err:   `/aggregate/groupBy/0: "aggregate" must contain non-empty group keys`,
+		},
+		{
+			input: `{"aggregate": {"functions": [{"op": "MEDIAN", "key": "person.code"}]}}`,
+			err:   `/aggregate/functions/0/op: unsupported aggregate function "MEDIAN"`,
+		},
+		{
+			input: `{"aggregate": {"functions": [{"op": "COUNT", "key": "person.code"}]}}`,
+			err:   "/aggregate/functions/0/key: COUNT function takes no key",
+		},
+		{
+			input: `{"aggregate": {"functions": [{"op": "SUM"}]}}`,
+			err:   "/aggregate/functions/0/key: SUM function requires a key",
+		},
+		{
+			input: `{"aggregate": {"functions": [{"op": "COUNT", "as": "total count"}]}}`,
+			err:   `/aggregate/functions/0/as: invalid aggregate alias "total count"`,
+		},
+		{
+			input: `{"aggregate": {"groupBy": ["state"], "functions": [{"op": "MAX", "key": "city", "as": "state"}]}}`,
+			err:   `/aggregate/functions/0/as: duplicate aggregate alias "state"`,
+		},
+	}
+	for _, test := range tests {
+		var mq MidQuery
+		err := json.Unmarshal([]byte(test.input), &mq)
+		if len(test.err) == 0 {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, test.err)
+		}
+	}
+
+	agg := &Aggregation{
+		GroupBy:   []string{"person.org", "state"},
+		Functions: []Aggregate{{Op: AVG, Key: "person.code", As: "avg_person_code"}},
+	}
+	assert.Equal(t, []string{"person_org", "state", "avg_person_code"}, agg.Aliases())
+}
+
+func TestSortDocuments(t *testing.T) {
+	docs := []interface{}{
+		map[string]interface{}{"state": "CA", "count": float64(2)},
+		map[string]interface{}{"state": "WA", "count": float64(3)},
+		map[string]interface{}{"state": "OR", "count": float64(2)},
+		map[string]interface{}{"count": float64(1)},
+	}
+	SortDocuments(docs, []Sorting{{Key: "count", Order: DESC}, {Key: "state"}})
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"state": "WA", "count": float64(3)},
+		map[string]interface{}{"state": "CA", "count": float64(2)},
+		map[string]interface{}{"state": "OR", "count": float64(2)},
+		map[string]interface{}{"count": float64(1)},
+	}, docs)
+}
@@ -0,0 +1,538 @@
+package queries
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ParseText parses a query in the text syntax, a compact alternative to JSON
+// for ad-hoc use:
+//
+//	person.org = "A" OR (person.org = "B" AND state IN ("CA", "WA")) ORDER BY state DESC LIMIT 2
+//
+// The filter is a boolean expression of AND, OR, NOT and parentheses over the predicates
+//
+//	key = value, key != value (or <>), key > value, key >= value, key < value, key <= value
+//	key IN (value, ...), key NOT IN (value, ...), key BETWEEN value AND value
+//	key STARTSWITH "str", key CONTAINS "str", key REGEX "pattern"
+//	key EXISTS, key NOT EXISTS, key IS NULL, key IS NOT NULL
+//	key ARRAY_CONTAINS value, ANY key (filter)
+//
+// The string comparisons (=, STARTSWITH, CONTAINS and REGEX) may be followed by IGNORECASE.
+// The values are "strings" with Go escapes, numbers, TRUE, FALSE, NULL and time
+// literals DATE "2021-06-01" (see DATE). Keys are dotted names, or any string in
+// backquotes. Keywords are case-insensitive and reserved; quote keys like `order`.
+// The filter is optional and followed by the optional ORDER BY and LIMIT clauses.
+func ParseText(text string) (*MidQuery, error) {
+	toks, err := lex(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &textParser{text: text, toks: toks}
+	return p.parseQuery()
+}
+
+// SyntaxError is an error in the text query; Line and Column (in characters)
+// start at 1, Offset is in bytes
+type SyntaxError struct {
+	Offset int
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+func newSyntaxError(text string, offset int, format string, args ...interface{}) *SyntaxError {
+	before := text[:offset]
+	line := strings.Count(before, "\n") + 1
+	if i := strings.LastIndexByte(before, '\n'); i >= 0 {
+		before = before[i+1:]
+	}
+	return &SyntaxError{
+		Offset: offset,
+		Line:   line,
+		Column: utf8.RuneCountInString(before) + 1,
+		Msg:    fmt.Sprintf(format, args...),
+	}
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokKey // backquoted
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type textToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t textToken) String() string {
+	if t.kind == tokEOF {
+		return "end of input"
+	}
+	return strconv.Quote(t.text)
+}
+
+var keywords = map[string]bool{
+	"AND": true, "OR": true, "NOT": true, "IN": true, "BETWEEN": true,
+	"STARTSWITH": true, "CONTAINS": true, "REGEX": true, "IGNORECASE": true,
+	"EXISTS": true, "IS": true, "NULL": true, "ARRAY_CONTAINS": true, "ANY": true,
+	"TRUE": true, "FALSE": true, "DATE": true,
+	"ORDER": true, "BY": true, "ASC": true, "DESC": true, "LIMIT": true,
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || c == '.' || '0' <= c && c <= '9'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func lex(text string) ([]textToken, error) {
+	toks := []textToken{}
+	for i := 0; i < len(text); {
+		c := text[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '(':
+			toks = append(toks, textToken{kind: tokLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			toks = append(toks, textToken{kind: tokRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			toks = append(toks, textToken{kind: tokComma, text: ",", pos: i})
+			i++
+		case c == '=':
+			toks = append(toks, textToken{kind: tokOp, text: "=", pos: i})
+			i++
+		case c == '!' || c == '<' || c == '>':
+			i++
+			if i < len(text) && (text[i] == '=' || c == '<' && text[i] == '>') {
+				i++
+			}
+			op := text[start:i]
+			if op == "!" {
+				return nil, newSyntaxError(text, start, "unexpected %q, did you mean \"!=\"", op)
+			}
+			toks = append(toks, textToken{kind: tokOp, text: op, pos: start})
+		case c == '"':
+			for i++; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+				if i < len(text) && text[i] == '\n' {
+					break
+				}
+			}
+			if i >= len(text) || text[i] != '"' {
+				return nil, newSyntaxError(text, start, "unterminated string")
+			}
+			i++
+			str, err := strconv.Unquote(text[start:i])
+			if err != nil {
+				return nil, newSyntaxError(text, start, "invalid string %s", text[start:i])
+			}
+			toks = append(toks, textToken{kind: tokString, text: str, pos: start})
+		case c == '`':
+			end := strings.IndexByte(text[i+1:], '`')
+			if end < 0 {
+				return nil, newSyntaxError(text, start, "unterminated key")
+			}
+			i += end + 2
+			toks = append(toks, textToken{kind: tokKey, text: text[start+1 : i-1], pos: start})
+		case isDigit(c) || c == '-' || c == '.':
+			i = scanNumber(text, i)
+			if _, err := strconv.ParseFloat(text[start:i], 64); err != nil {
+				return nil, newSyntaxError(text, start, "invalid number %q", text[start:i])
+			}
+			toks = append(toks, textToken{kind: tokNumber, text: text[start:i], pos: start})
+		case isIdentStart(c):
+			for i++; i < len(text) && isIdentPart(text[i]); i++ {
+			}
+			toks = append(toks, textToken{kind: tokIdent, text: text[start:i], pos: start})
+		default:
+			r, _ := utf8.DecodeRuneInString(text[i:])
+			return nil, newSyntaxError(text, start, "unexpected character %q", r)
+		}
+	}
+	return append(toks, textToken{kind: tokEOF, pos: len(text)}), nil
+}
+
+// scanNumber returns the end of the number in JSON syntax starting at i
+func scanNumber(text string, i int) int {
+	if i < len(text) && text[i] == '-' {
+		i++
+	}
+	for ; i < len(text) && isDigit(text[i]); i++ {
+	}
+	if i < len(text) && text[i] == '.' {
+		for i++; i < len(text) && isDigit(text[i]); i++ {
+		}
+	}
+	if i < len(text) && (text[i] == 'e' || text[i] == 'E') {
+		i++
+		if i < len(text) && (text[i] == '+' || text[i] == '-') {
+			i++
+		}
+		for ; i < len(text) && isDigit(text[i]); i++ {
+		}
+	}
+	return i
+}
+
+type textParser struct {
+	text string
+	toks []textToken
+	i    int
+}
+
+func (p *textParser) peek() textToken {
+	return p.toks[p.i]
+}
+
+func (p *textParser) next() textToken {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *textParser) errorf(t textToken, format string, args ...interface{}) error {
+	return newSyntaxError(p.text, t.pos, format, args...)
+}
+
+// isKeyword reports whether the token is one of the keywords
+func (t textToken) isKeyword(words ...string) bool {
+	if t.kind != tokIdent {
+		return false
+	}
+	for _, w := range words {
+		if strings.EqualFold(t.text, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept consumes the next token if it is the keyword
+func (p *textParser) accept(word string) bool {
+	if p.peek().isKeyword(word) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *textParser) expectKeyword(word string) error {
+	if !p.accept(word) {
+		return p.errorf(p.peek(), "expected %s, got %s", word, p.peek())
+	}
+	return nil
+}
+
+func (p *textParser) expect(kind tokenKind, what string) error {
+	if t := p.next(); t.kind != kind {
+		return p.errorf(t, "expected %s, got %s", what, t)
+	}
+	return nil
+}
+
+func (p *textParser) parseQuery() (*MidQuery, error) {
+	mq := &MidQuery{}
+	var err error
+	if t := p.peek(); t.kind != tokEOF && !t.isKeyword("ORDER", "LIMIT") {
+		if mq.Filter, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.accept("ORDER") {
+		if err = p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			key, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			s := Sorting{Key: key}
+			if t := p.peek(); t.isKeyword(ASC, DESC) {
+				s.Order = strings.ToUpper(p.next().text)
+			}
+			mq.Sort = append(mq.Sort, s)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+	}
+	if p.accept("LIMIT") {
+		t := p.next()
+		limit, err := strconv.Atoi(t.text)
+		if t.kind != tokNumber || err != nil || limit < 0 {
+			return nil, p.errorf(t, "expected a non-negative integer limit, got %s", t)
+		}
+		mq.Page.Limit = limit
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	if err = mq.Validate(); err != nil {
+		return nil, err
+	}
+	return mq, nil
+}
+
+func (p *textParser) parseOr() (Filter, error) {
+	return p.parseChain("OR", p.parseAnd, func(filters []Filter) Filter { return &FilterOR{Filters: filters} })
+}
+
+func (p *textParser) parseAnd() (Filter, error) {
+	return p.parseChain("AND", p.parseUnary, func(filters []Filter) Filter { return &FilterAND{Filters: filters} })
+}
+
+// parseChain parses the operands joined by the operator into a single filter
+func (p *textParser) parseChain(op string, operand func() (Filter, error), join func([]Filter) Filter) (Filter, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	filters := []Filter{first}
+	for p.accept(op) {
+		filter, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	if len(filters) == 1 {
+		return first, nil
+	}
+	return join(filters), nil
+}
+
+func (p *textParser) parseUnary() (Filter, error) {
+	t := p.peek()
+	switch {
+	case t.isKeyword("NOT"):
+		p.next()
+		filter, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &FilterNOT{Filter: filter}, nil
+	case t.kind == tokLParen:
+		p.next()
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return filter, p.expect(tokRParen, `")"`)
+	case t.isKeyword("ANY"):
+		p.next()
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(tokLParen, `"("`); err != nil {
+			return nil, err
+		}
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return &FilterANY{Key: key, Filter: filter}, p.expect(tokRParen, `")"`)
+	}
+	return p.parsePredicate()
+}
+
+func (p *textParser) parseKey() (string, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokKey && len(t.text) != 0:
+		return t.text, nil
+	case t.kind == tokIdent && !keywords[strings.ToUpper(t.text)]:
+		return t.text, nil
+	case t.kind == tokIdent:
+		return "", p.errorf(t, "expected key, got keyword %s; quote the key as `%s`", t, t.text)
+	default:
+		return "", p.errorf(t, "expected key, got %s", t)
+	}
+}
+
+func (p *textParser) parsePredicate() (Filter, error) {
+	start := p.peek()
+	key, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+	filter, err := p.parseCondition(key)
+	if err != nil {
+		return nil, err
+	}
+	// the semantic errors, e.g. invalid patterns, point at the predicate
+	if err = validateFilter(filter); err != nil {
+		var pe *PathError
+		if errors.As(err, &pe) {
+			err = pe.Err
+		}
+		return nil, p.errorf(start, "%v", err)
+	}
+	return filter, nil
+}
+
+func (p *textParser) parseCondition(key string) (Filter, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokOp:
+		val, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		switch t.text {
+		case "=":
+			return &FilterEQ{Key: key, Val: val, IgnoreCase: p.accept("IGNORECASE")}, nil
+		case "!=", "<>":
+			return &FilterNE{Key: key, Val: val}, nil
+		case ">":
+			return &FilterGT{Key: key, Val: val}, nil
+		case ">=":
+			return &FilterGTE{Key: key, Val: val}, nil
+		case "<":
+			return &FilterLT{Key: key, Val: val}, nil
+		default:
+			return &FilterLTE{Key: key, Val: val}, nil
+		}
+	case t.isKeyword("NOT"):
+		switch next := p.next(); {
+		case next.isKeyword("IN"):
+			filter, err := p.parseIn(key)
+			return &FilterNOT{Filter: filter}, err
+		case next.isKeyword("EXISTS"):
+			return &FilterNOT{Filter: &FilterEXISTS{Key: key}}, nil
+		default:
+			return nil, p.errorf(next, "expected IN or EXISTS, got %s", next)
+		}
+	case t.isKeyword("IN"):
+		return p.parseIn(key)
+	case t.isKeyword("BETWEEN"):
+		lower, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		upper, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return &FilterBETWEEN{Key: key, Lower: lower, Upper: upper, LowerInclusive: true, UpperInclusive: true}, nil
+	case t.isKeyword("STARTSWITH"), t.isKeyword("CONTAINS"), t.isKeyword("REGEX"):
+		str := p.next()
+		if str.kind != tokString {
+			return nil, p.errorf(str, "expected string, got %s", str)
+		}
+		ignoreCase := p.accept("IGNORECASE")
+		switch strings.ToUpper(t.text) {
+		case "STARTSWITH":
+			return &FilterSTARTSWITH{Key: key, Val: str.text, IgnoreCase: ignoreCase}, nil
+		case "CONTAINS":
+			return &FilterCONTAINS{Key: key, Val: str.text, IgnoreCase: ignoreCase}, nil
+		default:
+			return &FilterREGEX{Key: key, Pattern: str.text, IgnoreCase: ignoreCase}, nil
+		}
+	case t.isKeyword("EXISTS"):
+		return &FilterEXISTS{Key: key}, nil
+	case t.isKeyword("IS"):
+		not := p.accept("NOT")
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		if not {
+			return &FilterNOT{Filter: &FilterISNULL{Key: key}}, nil
+		}
+		return &FilterISNULL{Key: key}, nil
+	case t.isKeyword("ARRAY_CONTAINS"):
+		val, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return &FilterARRAYCONTAINS{Key: key, Val: val}, nil
+	default:
+		return nil, p.errorf(t, "expected operator after key %q, got %s", key, t)
+	}
+}
+
+func (p *textParser) parseIn(key string) (Filter, error) {
+	if err := p.expect(tokLParen, `"("`); err != nil {
+		return nil, err
+	}
+	vals := []interface{}{}
+	for {
+		val, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	return &FilterIN{Key: key, Vals: vals}, p.expect(tokRParen, `"," or ")"`)
+}
+
+// parseValue returns the value of the same type as in JSON queries
+func (p *textParser) parseValue() (interface{}, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokString:
+		return t.text, nil
+	case t.kind == tokNumber:
+		return strconv.ParseFloat(t.text, 64)
+	case t.isKeyword("TRUE"):
+		return true, nil
+	case t.isKeyword("FALSE"):
+		return false, nil
+	case t.isKeyword("NULL"):
+		return nil, nil
+	case t.isKeyword("DATE"):
+		str := p.next()
+		if str.kind != tokString {
+			return nil, p.errorf(str, "expected date string, got %s", str)
+		}
+		d, err := ParseDate(str.text)
+		if err != nil {
+			return nil, p.errorf(str, "%v", err)
+		}
+		return d, nil
+	default:
+		return nil, p.errorf(t, "expected value, got %s", t)
+	}
+}
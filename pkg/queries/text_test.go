@@ -0,0 +1,179 @@
+package queries
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseText(t *testing.T) {
+	tests := []struct {
+		input string
+		text  string
+	}{
+		{input: "../../tests/q1.json", text: `LIMIT 2`},
+		{input: "../../tests/q2.json", text: `state = "CA" LIMIT 2`},
+		{input: "../../tests/q3.json", text: `person.org = "A" AND state IN ("CA", "WA") ORDER BY state DESC, person.name`},
+		{input: "../../tests/q4.json", text: `person.org = "A" OR (person.org = "B" AND state IN ("CA","WA")) ORDER BY state DESC, person.name LIMIT 2`},
+		{input: "../../tests/q5.json", text: "state != \"CA\"\nAND city >= \"P\"\nAND person.name < \"M\"\norder by city"},
+		{input: "../../tests/q6.json", text: `person.org > "B" or state <= "CA" limit 3`},
+		{input: "../../tests/q7.json", text: `NOT (person.org = "A" AND state = "WA") ORDER BY person.name`},
+		{input: "../../tests/q8.json", text: `person.code >= 1002 AND person.code < 1008.5 AND person.code IN (1003, 1005, 1007) AND retired <> TRUE AND state != NULL ORDER BY person.code DESC`},
+		{input: "../../tests/q11.json", text: `person.name STARTSWITH "j" IGNORECASE OR city REGEX "^San " ORDER BY person.name`},
+		{input: "../../tests/q12.json", text: `person.code EXISTS AND state IS NOT NULL AND zip NOT EXISTS ORDER BY person.code DESC LIMIT 3`},
+		{input: "../../tests/q13.json", text: `tags ARRAY_CONTAINS "vip" OR ANY addresses (city = "Seattle" AND ANY phones (number STARTSWITH "+1"))`},
+	}
+	for _, test := range tests {
+		data, err := os.ReadFile(test.input)
+		require.NoError(t, err)
+		var expected MidQuery
+		require.NoError(t, json.Unmarshal(data, &expected))
+
+		mq, err := ParseText(test.text)
+		require.NoError(t, err, test.text)
+		assert.Equal(t, &expected, mq, test.input)
+	}
+}
+
+func TestParseTextValues(t *testing.T) {
+	tests := []struct {
+		text string
+		json string
+	}{
+		{
+			text: ``,
+			json: `{}`,
+		},
+		{
+			text: `a.b = -1.5e3 AND c = false AND d = "tab\t\"quoted\" é"`,
+			json: `{"filter": {"AND": [{"EQ": {"a.b": -1500}}, {"EQ": {"c": false}}, {"EQ": {"d": "tab\t\"quoted\" é"}}]}}`,
+		},
+		{
+			text: "`order` = 1 AND `first name` = \"Ann\" ORDER BY `order` desc",
+			json: `{"filter": {"AND": [{"EQ": {"order": 1}}, {"EQ": {"first name": "Ann"}}]}, "sort": [{"key": "order", "order": "DESC"}]}`,
+		},
+		{
+			text: `state = "ca" IGNORECASE AND city CONTAINS "san" ignorecase AND NOT NOT x IS NULL`,
+			json: `{"filter": {"AND": [{"EQ": {"state": "ca"}, "ignoreCase": true}, {"CONTAINS": {"city": "san"}, "ignoreCase": true}, {"NOT": {"NOT": {"ISNULL": "x"}}}]}}`,
+		},
+		{
+			text: `person.code BETWEEN 1003 AND 1005 AND joined > DATE "2021-06-01" AND state NOT IN ("CA")`,
+			json: `{"filter": {"AND": [{"BETWEEN": {"person.code": {"gte": 1003, "lte": 1005}}}, {"GT": {"joined": {"$date": "2021-06-01"}}}, {"NOT": {"IN": {"state": ["CA"]}}}]}}`,
+		},
+		{
+			// AND binds tighter than OR
+			text: `a = 1 OR b = 2 AND c = 3 OR d = 4`,
+			json: `{"filter": {"OR": [{"EQ": {"a": 1}}, {"AND": [{"EQ": {"b": 2}}, {"EQ": {"c": 3}}]}, {"EQ": {"d": 4}}]}}`,
+		},
+		{
+			text: `ORDER BY a, b DESC, c asc`,
+			json: `{"sort": [{"key": "a"}, {"key": "b", "order": "DESC"}, {"key": "c", "order": "ASC"}]}`,
+		},
+	}
+	for _, test := range tests {
+		var expected MidQuery
+		require.NoError(t, json.Unmarshal([]byte(test.json), &expected))
+		mq, err := ParseText(test.text)
+		require.NoError(t, err, test.text)
+		assert.Equal(t, &expected, mq, test.text)
+	}
+}
+
+func TestParseTextErrors(t *testing.T) {
+	tests := []struct {
+		text   string
+		err    string
+		offset int
+	}{
+		{
+			text:   `state = "CA" AND`,
+			err:    "syntax error at line 1, column 17: expected key, got end of input",
+			offset: 16,
+		},
+		{
+			text:   `state = "CA" AND (city = "Seattle"`,
+			err:    `syntax error at line 1, column 35: expected ")", got end of input`,
+			offset: 34,
+		},
+		{
+			text:   `state IN ("CA" "WA")`,
+			err:    `syntax error at line 1, column 16: expected "," or ")", got "WA"`,
+			offset: 15,
+		},
+		{
+			text:   `state == "CA"`,
+			err:    `syntax error at line 1, column 8: expected value, got "="`,
+			offset: 7,
+		},
+		{
+			text:   `state LIKE "C%"`,
+			err:    `syntax error at line 1, column 7: expected operator after key "state", got "LIKE"`,
+			offset: 6,
+		},
+		{
+			text:   "state = \"CA\"\n  AND city = \"San Diego",
+			err:    "syntax error at line 2, column 14: unterminated string",
+			offset: 26,
+		},
+		{
+			text:   `name = "Zoë" AND # = 1`,
+			err:    `syntax error at line 1, column 18: unexpected character '#'`,
+			offset: 18,
+		},
+		{
+			text:   `a = 1 AND order = 1`,
+			err:    "syntax error at line 1, column 11: expected key, got keyword \"order\"; quote the key as `order`",
+			offset: 10,
+		},
+		{
+			text:   `state = "CA" ORDER state`,
+			err:    `syntax error at line 1, column 20: expected BY, got "state"`,
+			offset: 19,
+		},
+		{
+			text:   `state = "CA" LIMIT -1`,
+			err:    `syntax error at line 1, column 20: expected a non-negative integer limit, got "-1"`,
+			offset: 19,
+		},
+		{
+			text:   `state = "CA" LIMIT 2 state = "WA"`,
+			err:    `syntax error at line 1, column 22: unexpected "state"`,
+			offset: 21,
+		},
+		{
+			text:   `a = 1 AND city REGEX "San ("`,
+			err:    "syntax error at line 1, column 11: REGEX filter has invalid pattern: error parsing regexp: missing closing ): `San (`",
+			offset: 10,
+		},
+		{
+			text:   `code BETWEEN 5 AND "a"`,
+			err:    "syntax error at line 1, column 1: BETWEEN filter has bounds of mismatched types float64 and string",
+			offset: 0,
+		},
+		{
+			text:   `joined > DATE "yesterday"`,
+			err:    `syntax error at line 1, column 15: invalid date "yesterday": expected RFC 3339 time, YYYY-MM-DD or now[+-]N(s|m|h|d|w)`,
+			offset: 14,
+		},
+		{
+			text:   `code = 1.2.3`,
+			err:    `syntax error at line 1, column 11: unexpected ".3"`,
+			offset: 10,
+		},
+		{
+			text:   `code = 1 ! 2`,
+			err:    `syntax error at line 1, column 10: unexpected "!", did you mean "!="`,
+			offset: 9,
+		},
+	}
+	for _, test := range tests {
+		_, err := ParseText(test.text)
+		assert.EqualError(t, err, test.err, test.text)
+		if se, ok := err.(*SyntaxError); assert.True(t, ok, test.text) {
+			assert.Equal(t, test.offset, se.Offset, test.text)
+		}
+	}
+}
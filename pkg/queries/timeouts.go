@@ -0,0 +1,58 @@
+package queries
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultQueryTimeout   = 30 * time.Second
+	DefaultWriteTimeout   = 10 * time.Second
+)
+
+// Timeouts limit the duration of a single backend operation.
+// Zero value means no limit other than the deadline of the context.
+type Timeouts struct {
+	Connect time.Duration // connecting to the database
+	Query   time.Duration // fetching a single page of results
+	Write   time.Duration // writing a single document
+}
+
+// GetTimeouts reads "connectTimeout", "queryTimeout" and "writeTimeout"
+// (e.g. "30s", "0" to disable) from the config, falling back to the defaults
+func GetTimeouts(cfg map[string]string) (Timeouts, error) {
+	timeouts := Timeouts{
+		Connect: DefaultConnectTimeout,
+		Query:   DefaultQueryTimeout,
+		Write:   DefaultWriteTimeout,
+	}
+	for key, d := range map[string]*time.Duration{
+		"connectTimeout": &timeouts.Connect,
+		"queryTimeout":   &timeouts.Query,
+		"writeTimeout":   &timeouts.Write,
+	} {
+		val, ok := cfg[key]
+		if !ok {
+			continue
+		}
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return timeouts, fmt.Errorf("invalid %s %q: %v", key, val, err)
+		}
+		if dur < 0 {
+			return timeouts, fmt.Errorf("invalid %s %q: must not be negative", key, val)
+		}
+		*d = dur
+	}
+	return timeouts, nil
+}
+
+// WithTimeout derives a context bound by the timeout, unless the timeout is zero
+func WithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,283 @@
+package queries
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const TokenVersion = 1
+
+var ErrInvalidToken = errors.New("invalid pagination token")
+
+// TokenCodec converts backend cursors (a skip count, a continuation header, ...) into
+// opaque pagination tokens and back. The token carries the backend name and the
+// fingerprint of the query, so it cannot be replayed against another query or
+// backend. With a secret, the token is signed with HMAC-SHA256 to detect tampering.
+type TokenCodec struct {
+	backend string
+	secret  []byte
+}
+
+type tokenPayload struct {
+	Version int    `json:"v"`
+	Backend string `json:"b"`
+	Query   string `json:"q"`
+	Cursor  string `json:"c"`
+}
+
+func NewTokenCodec(backend string, secret []byte) *TokenCodec {
+	return &TokenCodec{
+		backend: backend,
+		secret:  secret,
+	}
+}
+
+// Encode wraps the backend cursor of the query. An empty cursor (no more pages)
+// produces an empty token.
+func (c *TokenCodec) Encode(mq *MidQuery, cursor string) (string, error) {
+	if len(cursor) == 0 {
+		return "", nil
+	}
+	fp, err := Fingerprint(mq)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&tokenPayload{
+		Version: TokenVersion,
+		Backend: c.backend,
+		Query:   fp,
+		Cursor:  cursor,
+	})
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(data)
+	if len(c.secret) != 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(c.sign(data))
+	}
+	return token, nil
+}
+
+// Decode verifies the token against the query and returns the backend cursor
+func (c *TokenCodec) Decode(mq *MidQuery, token string) (string, error) {
+	if len(token) == 0 {
+		return "", nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) > 2 {
+		return "", fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	switch {
+	case len(c.secret) != 0 && len(parts) == 1:
+		return "", fmt.Errorf("%w: missing signature", ErrInvalidToken)
+	case len(c.secret) != 0:
+		sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil || !hmac.Equal(sig, c.sign(data)) {
+			return "", fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+		}
+	case len(parts) == 2:
+		return "", fmt.Errorf("%w: unexpected signature", ErrInvalidToken)
+	}
+	var payload tokenPayload
+	if err = json.Unmarshal(data, &payload); err != nil {
+		return "", fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	if payload.Version != TokenVersion {
+		return "", fmt.Errorf("%w: unsupported version %d", ErrInvalidToken, payload.Version)
+	}
+	if payload.Backend != c.backend {
+		return "", fmt.Errorf("%w: token belongs to backend %q", ErrInvalidToken, payload.Backend)
+	}
+	fp, err := Fingerprint(mq)
+	if err != nil {
+		return "", err
+	}
+	if payload.Query != fp {
+		return "", fmt.Errorf("%w: token belongs to another query", ErrInvalidToken)
+	}
+	if len(payload.Cursor) == 0 {
+		return "", fmt.Errorf("%w: empty cursor", ErrInvalidToken)
+	}
+	return payload.Cursor, nil
+}
+
+func (c *TokenCodec) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Fingerprint identifies the result set of the query, i.e. its filter and sort order.
+// The pagination settings are not part of the fingerprint.
+func Fingerprint(mq *MidQuery) (string, error) {
+	var sb strings.Builder
+	if mq.Filter != nil {
+		str, err := VisitFilter(fingerprinter{}, mq.Filter)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(str.(string))
+	}
+	for _, s := range mq.Sort {
+		order := ASC
+		if s.Order == DESC {
+			order = DESC
+		}
+		fmt.Fprintf(&sb, "|%s:%s", strconv.Quote(s.Key), order)
+	}
+	sum := sha256.Sum256([]byte(sb.String()))
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// fingerprinter renders the filter tree in a canonical text form
+type fingerprinter struct{}
+
+func (fp fingerprinter) value(v interface{}) string {
+	if f, ok := ToFloat(v); ok {
+		return "n:" + strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "s:" + strconv.Quote(val)
+	case Date:
+		// a relative date keeps its fingerprint while the time passes
+		if len(val.Expr) != 0 {
+			return "d:" + val.Expr
+		}
+		return "d:" + val.String()
+	default:
+		return fmt.Sprintf("%T:%v", val, val)
+	}
+}
+
+// op marks the case-insensitive variant of the operator
+func (fp fingerprinter) op(op string, ignoreCase bool) string {
+	if ignoreCase {
+		return op + "/i"
+	}
+	return op
+}
+
+func (fp fingerprinter) keyValue(op, key string, val interface{}) (interface{}, error) {
+	return fmt.Sprintf("%s(%s,%s)", op, strconv.Quote(key), fp.value(val)), nil
+}
+
+func (fp fingerprinter) filters(op string, filters []Filter) (interface{}, error) {
+	arr := make([]string, len(filters))
+	for i, filter := range filters {
+		str, err := VisitFilter(fp, filter)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = str.(string)
+	}
+	return fmt.Sprintf("%s(%s)", op, strings.Join(arr, ",")), nil
+}
+
+func (fp fingerprinter) VisitEQ(f *FilterEQ) (interface{}, error) {
+	return fp.keyValue(fp.op("EQ", f.IgnoreCase), f.Key, f.Val)
+}
+
+func (fp fingerprinter) VisitNE(f *FilterNE) (interface{}, error) {
+	return fp.keyValue("NE", f.Key, f.Val)
+}
+
+func (fp fingerprinter) VisitGT(f *FilterGT) (interface{}, error) {
+	return fp.keyValue("GT", f.Key, f.Val)
+}
+
+func (fp fingerprinter) VisitGTE(f *FilterGTE) (interface{}, error) {
+	return fp.keyValue("GTE", f.Key, f.Val)
+}
+
+func (fp fingerprinter) VisitLT(f *FilterLT) (interface{}, error) {
+	return fp.keyValue("LT", f.Key, f.Val)
+}
+
+func (fp fingerprinter) VisitLTE(f *FilterLTE) (interface{}, error) {
+	return fp.keyValue("LTE", f.Key, f.Val)
+}
+
+func (fp fingerprinter) VisitIN(f *FilterIN) (interface{}, error) {
+	// the order of the values does not change the result set
+	vals := make([]string, len(f.Vals))
+	for i, v := range f.Vals {
+		vals[i] = fp.value(v)
+	}
+	sort.Strings(vals)
+	return fmt.Sprintf("IN(%s,[%s])", strconv.Quote(f.Key), strings.Join(vals, ",")), nil
+}
+
+func (fp fingerprinter) VisitBETWEEN(f *FilterBETWEEN) (interface{}, error) {
+	// interval notation: [lower,upper) etc.
+	left, right := "(", ")"
+	if f.LowerInclusive {
+		left = "["
+	}
+	if f.UpperInclusive {
+		right = "]"
+	}
+	return fmt.Sprintf("BETWEEN(%s,%s%s,%s%s)", strconv.Quote(f.Key), left, fp.value(f.Lower), fp.value(f.Upper), right), nil
+}
+
+func (fp fingerprinter) VisitSTARTSWITH(f *FilterSTARTSWITH) (interface{}, error) {
+	return fp.keyValue(fp.op("STARTSWITH", f.IgnoreCase), f.Key, f.Val)
+}
+
+func (fp fingerprinter) VisitCONTAINS(f *FilterCONTAINS) (interface{}, error) {
+	return fp.keyValue(fp.op("CONTAINS", f.IgnoreCase), f.Key, f.Val)
+}
+
+func (fp fingerprinter) VisitREGEX(f *FilterREGEX) (interface{}, error) {
+	return fp.keyValue(fp.op("REGEX", f.IgnoreCase), f.Key, f.Pattern)
+}
+
+func (fp fingerprinter) VisitEXISTS(f *FilterEXISTS) (interface{}, error) {
+	return fmt.Sprintf("EXISTS(%s)", strconv.Quote(f.Key)), nil
+}
+
+func (fp fingerprinter) VisitISNULL(f *FilterISNULL) (interface{}, error) {
+	return fmt.Sprintf("ISNULL(%s)", strconv.Quote(f.Key)), nil
+}
+
+func (fp fingerprinter) VisitARRAYCONTAINS(f *FilterARRAYCONTAINS) (interface{}, error) {
+	return fp.keyValue("ARRAY_CONTAINS", f.Key, f.Val)
+}
+
+func (fp fingerprinter) VisitANY(f *FilterANY) (interface{}, error) {
+	str, err := VisitFilter(fp, f.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("ANY(%s,%s)", strconv.Quote(f.Key), str), nil
+}
+
+func (fp fingerprinter) VisitAND(f *FilterAND) (interface{}, error) {
+	return fp.filters("AND", f.Filters)
+}
+
+func (fp fingerprinter) VisitOR(f *FilterOR) (interface{}, error) {
+	return fp.filters("OR", f.Filters)
+}
+
+func (fp fingerprinter) VisitNOT(f *FilterNOT) (interface{}, error) {
+	return fp.filters("NOT", []Filter{f.Filter})
+}
+
+func (fp fingerprinter) Finalize(interface{}, *MidQuery) error {
+	return nil
+}
@@ -0,0 +1,137 @@
+package queries
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenCodec(t *testing.T) {
+	mq := &MidQuery{
+		Filter: &FilterAND{
+			Filters: []Filter{
+				&FilterEQ{Key: "person.org", Val: "A"},
+				&FilterIN{Key: "state", Vals: []interface{}{"CA", "WA"}},
+			},
+		},
+		Sort: []Sorting{{Key: "state", Order: DESC}},
+		Page: Pagination{Limit: 2},
+	}
+	// same result set: IN values reordered, different page size
+	same := &MidQuery{
+		Filter: &FilterAND{
+			Filters: []Filter{
+				&FilterEQ{Key: "person.org", Val: "A"},
+				&FilterIN{Key: "state", Vals: []interface{}{"WA", "CA"}},
+			},
+		},
+		Sort: []Sorting{{Key: "state", Order: DESC}},
+		Page: Pagination{Limit: 5},
+	}
+	other := &MidQuery{
+		Filter: &FilterEQ{Key: "person.org", Val: "A"},
+		Sort:   []Sorting{{Key: "state", Order: DESC}},
+	}
+	otherSort := &MidQuery{
+		Filter: mq.Filter,
+		Sort:   []Sorting{{Key: "state", Order: ASC}},
+	}
+	otherCase := &MidQuery{
+		Filter: &FilterAND{
+			Filters: []Filter{
+				&FilterEQ{Key: "person.org", Val: "A", IgnoreCase: true},
+				&FilterIN{Key: "state", Vals: []interface{}{"CA", "WA"}},
+			},
+		},
+		Sort: []Sorting{{Key: "state", Order: DESC}},
+	}
+
+	for _, secret := range []string{"", "secret"} {
+		codec := NewTokenCodec("mongodb", []byte(secret))
+
+		token, err := codec.Encode(mq, "")
+		assert.NoError(t, err)
+		assert.Empty(t, token)
+		cursor, err := codec.Decode(mq, "")
+		assert.NoError(t, err)
+		assert.Empty(t, cursor)
+
+		token, err = codec.Encode(mq, "42")
+		assert.NoError(t, err)
+		assert.NotContains(t, token, "42")
+		assert.Equal(t, len(secret) != 0, strings.Contains(token, "."))
+
+		cursor, err = codec.Decode(mq, token)
+		assert.NoError(t, err)
+		assert.Equal(t, "42", cursor)
+
+		cursor, err = codec.Decode(same, token)
+		assert.NoError(t, err)
+		assert.Equal(t, "42", cursor)
+
+		_, err = codec.Decode(other, token)
+		assert.True(t, errors.Is(err, ErrInvalidToken))
+		assert.EqualError(t, err, "invalid pagination token: token belongs to another query")
+
+		_, err = codec.Decode(otherSort, token)
+		assert.EqualError(t, err, "invalid pagination token: token belongs to another query")
+
+		_, err = codec.Decode(otherCase, token)
+		assert.EqualError(t, err, "invalid pagination token: token belongs to another query")
+
+		_, err = NewTokenCodec("cosmosdb", []byte(secret)).Decode(mq, token)
+		assert.EqualError(t, err, `invalid pagination token: token belongs to backend "mongodb"`)
+
+		_, err = codec.Decode(mq, "42")
+		assert.True(t, errors.Is(err, ErrInvalidToken))
+	}
+}
+
+func TestFingerprintBounds(t *testing.T) {
+	between := func(lowerInclusive bool) *MidQuery {
+		return &MidQuery{Filter: &FilterBETWEEN{Key: "person.code", Lower: 1, Upper: 2, LowerInclusive: lowerInclusive}}
+	}
+	inclusive, err := Fingerprint(between(true))
+	assert.NoError(t, err)
+	exclusive, err := Fingerprint(between(false))
+	assert.NoError(t, err)
+	assert.NotEqual(t, inclusive, exclusive)
+}
+
+func TestTokenSignature(t *testing.T) {
+	mq := &MidQuery{Filter: &FilterEQ{Key: "state", Val: "CA"}}
+	codec := NewTokenCodec("mongodb", []byte("secret"))
+	token, err := codec.Encode(mq, "2")
+	assert.NoError(t, err)
+
+	// tampered cursor
+	parts := strings.Split(token, ".")
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	assert.NoError(t, err)
+	data = []byte(strings.Replace(string(data), `"c":"2"`, `"c":"0"`, 1))
+	tampered := base64.RawURLEncoding.EncodeToString(data) + "." + parts[1]
+	_, err = codec.Decode(mq, tampered)
+	assert.EqualError(t, err, "invalid pagination token: signature mismatch")
+
+	// unsigned token
+	_, err = codec.Decode(mq, parts[0])
+	assert.EqualError(t, err, "invalid pagination token: missing signature")
+
+	// wrong secret
+	_, err = NewTokenCodec("mongodb", []byte("other")).Decode(mq, token)
+	assert.EqualError(t, err, "invalid pagination token: signature mismatch")
+
+	// signed token without configured secret
+	_, err = NewTokenCodec("mongodb", nil).Decode(mq, token)
+	assert.EqualError(t, err, "invalid pagination token: unexpected signature")
+
+	// unsigned tampered token is accepted only without a secret
+	unsigned, err := NewTokenCodec("mongodb", nil).Encode(mq, "2")
+	assert.NoError(t, err)
+	cursor, err := NewTokenCodec("mongodb", nil).Decode(mq, unsigned)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", cursor)
+}
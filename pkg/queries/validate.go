@@ -0,0 +1,245 @@
+package queries
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PathError is an error in a part of the query, located by a JSON pointer
+// (RFC 6901) such as /filter/OR/1/AND/0/IN
+type PathError struct {
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// atPath prefixes the location of the error with the segment, as the error
+// is passed up from the nested parts of the query
+func atPath(segment string, err error) error {
+	if err == nil {
+		return nil
+	}
+	segment = "/" + pointerEscaper.Replace(segment)
+	if pe, ok := err.(*PathError); ok {
+		return &PathError{Path: segment + pe.Path, Err: pe.Err}
+	}
+	return &PathError{Path: segment, Err: err}
+}
+
+func atIndex(i int, err error) error {
+	return atPath(strconv.Itoa(i), err)
+}
+
+// checkKeys rejects the keys of the object that are not in the allowed list
+func checkKeys(m map[string]interface{}, allowed ...string) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		found := false
+		for _, a := range allowed {
+			found = found || k == a
+		}
+		if !found {
+			return atPath(k, fmt.Errorf("unknown key %q; expected one of %s", k, strings.Join(allowed, ", ")))
+		}
+	}
+	return nil
+}
+
+// Validate checks the semantics of the query: the filter tree, the sort orders,
+// the selected fields, the pagination and the aggregation. UnmarshalJSON validates
+// the parsed query; queries built in code should be validated before use.
+func (q *MidQuery) Validate() error {
+	if q.Filter != nil {
+		if err := validateFilter(q.Filter); err != nil {
+			return atPath(FILTER, err)
+		}
+	}
+	for i, s := range q.Sort {
+		if len(s.Key) == 0 {
+			return atPath(SORT, atIndex(i, atPath("key", fmt.Errorf("sort key must not be empty"))))
+		}
+		if s.Order != "" && s.Order != ASC && s.Order != DESC {
+			return atPath(SORT, atIndex(i, atPath("order", fmt.Errorf("sort order must be %s or %s, got %q", ASC, DESC, s.Order))))
+		}
+	}
+	for i, field := range q.Select {
+		if len(field) == 0 {
+			return atPath(SELECT, atIndex(i, fmt.Errorf("%q must contain non-empty field names", SELECT)))
+		}
+	}
+	if q.Page.Limit < 0 {
+		return atPath(PAGE, atPath("limit", fmt.Errorf("limit must not be negative")))
+	}
+	if q.Aggregate != nil {
+		if err := q.Aggregate.validate(); err != nil {
+			return atPath(AGGREGATE, err)
+		}
+	}
+	return nil
+}
+
+// validateFilter checks the filter tree built in code like the parser checks the JSON one
+func validateFilter(filter Filter) error {
+	if filter == nil {
+		return fmt.Errorf("missing filter")
+	}
+	op, err := FilterOp(filter)
+	if err != nil {
+		return err
+	}
+	return atPath(op, validateNode(op, filter))
+}
+
+func validateNode(op string, filter Filter) error {
+	switch f := filter.(type) {
+	case *FilterEQ:
+		if err := checkKeyValue(op, f.Key, f.Val); err != nil {
+			return err
+		}
+		if _, ok := f.Val.(string); f.IgnoreCase && !ok {
+			return fmt.Errorf("%q requires a string value in %s filter", IGNORECASE, op)
+		}
+	case *FilterNE:
+		return checkKeyValue(op, f.Key, f.Val)
+	case *FilterGT:
+		return checkKeyValue(op, f.Key, f.Val)
+	case *FilterGTE:
+		return checkKeyValue(op, f.Key, f.Val)
+	case *FilterLT:
+		return checkKeyValue(op, f.Key, f.Val)
+	case *FilterLTE:
+		return checkKeyValue(op, f.Key, f.Val)
+	case *FilterARRAYCONTAINS:
+		return checkKeyValue(op, f.Key, f.Val)
+	case *FilterIN:
+		if err := checkFilterKey(op, f.Key); err != nil {
+			return err
+		}
+		if len(f.Vals) == 0 {
+			return atPath(f.Key, fmt.Errorf("IN filter value must not be empty"))
+		}
+		for _, v := range f.Vals {
+			if err := checkValue(op, v); err != nil {
+				return err
+			}
+		}
+	case *FilterBETWEEN:
+		if err := checkFilterKey(op, f.Key); err != nil {
+			return err
+		}
+		return f.checkBounds()
+	case *FilterSTARTSWITH:
+		return checkFilterKey(op, f.Key)
+	case *FilterCONTAINS:
+		return checkFilterKey(op, f.Key)
+	case *FilterREGEX:
+		if err := checkFilterKey(op, f.Key); err != nil {
+			return err
+		}
+		if _, err := regexp.Compile(f.Pattern); err != nil {
+			return fmt.Errorf("REGEX filter has invalid pattern: %v", err)
+		}
+	case *FilterEXISTS:
+		return checkFilterKey(op, f.Key)
+	case *FilterISNULL:
+		return checkFilterKey(op, f.Key)
+	case *FilterANY:
+		if err := checkFilterKey(op, f.Key); err != nil {
+			return err
+		}
+		return atPath(f.Key, validateFilter(f.Filter))
+	case *FilterAND:
+		return validateFilters(op, f.Filters)
+	case *FilterOR:
+		return validateFilters(op, f.Filters)
+	case *FilterNOT:
+		return validateFilter(f.Filter)
+	}
+	return nil
+}
+
+func validateFilters(op string, filters []Filter) error {
+	if len(filters) < 2 {
+		return fmt.Errorf("%s filter must contain at least two entries", op)
+	}
+	for i, filter := range filters {
+		if err := validateFilter(filter); err != nil {
+			return atIndex(i, err)
+		}
+	}
+	return nil
+}
+
+func checkFilterKey(op, key string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("%s filter must have a non-empty key", op)
+	}
+	return nil
+}
+
+func checkKeyValue(op, key string, val interface{}) error {
+	if err := checkFilterKey(op, key); err != nil {
+		return err
+	}
+	return checkValue(op, val)
+}
+
+// FilterOp returns the operator of the filter in the query grammar
+func FilterOp(filter Filter) (string, error) {
+	switch filter.(type) {
+	case *FilterEQ:
+		return "EQ", nil
+	case *FilterNE:
+		return "NE", nil
+	case *FilterGT:
+		return "GT", nil
+	case *FilterGTE:
+		return "GTE", nil
+	case *FilterLT:
+		return "LT", nil
+	case *FilterLTE:
+		return "LTE", nil
+	case *FilterIN:
+		return "IN", nil
+	case *FilterBETWEEN:
+		return "BETWEEN", nil
+	case *FilterSTARTSWITH:
+		return "STARTSWITH", nil
+	case *FilterCONTAINS:
+		return "CONTAINS", nil
+	case *FilterREGEX:
+		return "REGEX", nil
+	case *FilterEXISTS:
+		return "EXISTS", nil
+	case *FilterISNULL:
+		return "ISNULL", nil
+	case *FilterARRAYCONTAINS:
+		return "ARRAY_CONTAINS", nil
+	case *FilterANY:
+		return "ANY", nil
+	case *FilterAND:
+		return "AND", nil
+	case *FilterOR:
+		return "OR", nil
+	case *FilterNOT:
+		return "NOT", nil
+	default:
+		return "", fmt.Errorf("Unsupported filter type %#v", filter)
+	}
+}
@@ -0,0 +1,191 @@
+package queries
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidation(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{
+			input: `{"filter": {"EQ": {"state": "CA"}}, "sort": [{"key": "state", "order": "DESC"}], "select": ["state"], "pagination": {"limit": 2, "token": "", "withTotal": true}}`,
+		},
+		{
+			input: `{"filter": {"EQ": {"state": "CA"}}, "limit": 2}`,
+			err:   `/limit: unknown key "limit"; expected one of filter, sort, select, aggregate, pagination`,
+		},
+		{
+			input: `{"filter": {"OR": [{"EQ": {"state": "CA"}}, {"AND": [{"IN": {"state": "WA"}}, {"EQ": {"city": "Seattle"}}]}]}}`,
+			err:   `/filter/OR/1/AND/0/IN/state: IN filter value must be an array`,
+		},
+		{
+			input: `{"filter": {}, "sort": [{"key": "state"}]}`,
+			err:   `/filter: "filter" must contain a filter`,
+		},
+		{
+			input: `{"filter": {"ignoreCase": true}}`,
+			err:   `/filter: "ignoreCase" must be next to a filter`,
+		},
+		{
+			input: `{"filter": {"AND": [{"EQ": {"state": "CA"}}, {"IN": {"person.org": []}}]}}`,
+			err:   `/filter/AND/1/IN/person.org: IN filter value must not be empty`,
+		},
+		{
+			input: `{"filter": {"NOT": {"LIKE": {"state": "C%"}}}}`,
+			err:   `/filter/NOT/LIKE: unsupported filter operator "LIKE"`,
+		},
+		{
+			input: `{"filter": {"AND": [{"EQ": {"state": "CA"}}, {}]}}`,
+			err:   `/filter/AND/1: AND filter entry must contain a filter`,
+		},
+		{
+			input: `{"filter": {"ANY": {"a/b~c": {"GT": {"x": [1]}}}}}`,
+			err:   `/filter/ANY/a~1b~0c/GT: GT filter has unsupported value type []interface {}`,
+		},
+		{
+			input: `{"filter": {"EQ": {"state": "CA"}, "ignoreCase": "yes"}}`,
+			err:   `/filter/ignoreCase: "ignoreCase" must be a boolean`,
+		},
+		{
+			input: `{"sort": [{"key": "state", "order": "asc"}]}`,
+			err:   `/sort/0/order: sort order must be ASC or DESC, got "asc"`,
+		},
+		{
+			input: `{"sort": [{"key": "state"}, {"key": "city", "dir": "DESC"}]}`,
+			err:   `/sort/1/dir: unknown key "dir"; expected one of key, order`,
+		},
+		{
+			input: `{"sort": [{"key": ""}]}`,
+			err:   `/sort/0/key: sort key must not be empty`,
+		},
+		{
+			input: `{"sort": [{"key": 1}]}`,
+			err:   `/sort/0/key: sort key must be a string`,
+		},
+		{
+			input: `{"sort": ["state"]}`,
+			err:   `/sort/0: sort entry must be a map`,
+		},
+		{
+			input: `{"pagination": {"limit": 2, "offset": 4}}`,
+			err:   `/pagination/offset: unknown key "offset"; expected one of limit, token, withTotal`,
+		},
+		{
+			input: `{"pagination": {"limit": 2.5}}`,
+			err:   `/pagination/limit: limit must be an integer`,
+		},
+		{
+			input: `{"pagination": {"limit": -1}}`,
+			err:   `/pagination/limit: limit must not be negative`,
+		},
+		{
+			input: `{"pagination": {"withTotal": "yes"}}`,
+			err:   `/pagination/withTotal: withTotal must be a boolean`,
+		},
+		{
+			input: `{"aggregate": {"groupBy": ["state"], "functions": [{"op": "COUNT"}], "having": {}}}`,
+			err:   `/aggregate/having: unknown key "having"; expected one of groupBy, functions`,
+		},
+		{
+			input: `{"aggregate": {"functions": [{"op": "COUNT"}, {"op": "SUM", "field": "person.code"}]}}`,
+			err:   `/aggregate/functions/1/field: unknown key "field"; expected one of op, key, as`,
+		},
+		{
+			input: `{"aggregate": {"functions": [{"op": "COUNT"}, "SUM"]}}`,
+			err:   `/aggregate/functions/1: "aggregate" function must be a map`,
+		},
+		{
+			input: `{"aggregate": {"functions": {"op": "COUNT"}}}`,
+			err:   `/aggregate/functions: "aggregate" functions must be an array`,
+		},
+		{
+			input: `{"aggregate": {"functions": [{"op": "SUM", "key": ["person.code"]}]}}`,
+			err:   `/aggregate/functions/0/key: "aggregate" function key must be a string`,
+		},
+		{
+			input: `{"aggregate": {"groupBy": ["state", 1], "functions": [{"op": "COUNT"}]}}`,
+			err:   `/aggregate/groupBy/1: "aggregate" group key must be a string`,
+		},
+	}
+	for _, test := range tests {
+		var mq MidQuery
+		err := json.Unmarshal([]byte(test.input), &mq)
+		if len(test.err) == 0 {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, test.err, test.input)
+		}
+	}
+
+	var mq MidQuery
+	err := json.Unmarshal([]byte(`{"filter": {"NOT": {"EQ": {"": 1}}}}`), &mq)
+	var pe *PathError
+	require.True(t, errors.As(err, &pe))
+	assert.Equal(t, "/filter/NOT/EQ", pe.Path)
+	assert.EqualError(t, pe.Err, "EQ filter must have a non-empty key")
+}
+
+func TestValidateBuiltQuery(t *testing.T) {
+	tests := []struct {
+		query MidQuery
+		err   string
+	}{
+		{
+			query: MidQuery{
+				Filter: &FilterAND{Filters: []Filter{&FilterEQ{Key: "state", Val: "CA"}, &FilterNOT{Filter: &FilterEXISTS{Key: "zip"}}}},
+				Sort:   []Sorting{{Key: "state", Order: DESC}, {Key: "city"}},
+			},
+		},
+		{
+			query: MidQuery{Filter: &FilterOR{Filters: []Filter{&FilterEQ{Key: "state", Val: "CA"}}}},
+			err:   "/filter/OR: OR filter must contain at least two entries",
+		},
+		{
+			query: MidQuery{Filter: &FilterOR{Filters: []Filter{&FilterEQ{Key: "state", Val: "CA"}, &FilterNOT{}}}},
+			err:   "/filter/OR/1/NOT: missing filter",
+		},
+		{
+			query: MidQuery{Filter: &FilterIN{Key: "state", Vals: []interface{}{"CA", []string{"WA"}}}},
+			err:   "/filter/IN: IN filter has unsupported value type []string",
+		},
+		{
+			query: MidQuery{Filter: &FilterNOT{Filter: &FilterIN{Key: "state"}}},
+			err:   "/filter/NOT/IN/state: IN filter value must not be empty",
+		},
+		{
+			query: MidQuery{Filter: &FilterEQ{Key: "code", Val: 1, IgnoreCase: true}},
+			err:   `/filter/EQ: "ignoreCase" requires a string value in EQ filter`,
+		},
+		{
+			query: MidQuery{Filter: &FilterBETWEEN{Key: "code", Lower: 5, Upper: 1}},
+			err:   "/filter/BETWEEN: BETWEEN filter has lower bound greater than upper bound",
+		},
+		{
+			query: MidQuery{Filter: &FilterANY{Key: "tags", Filter: &FilterREGEX{Key: "name", Pattern: "("}}},
+			err:   "/filter/ANY/tags/REGEX: REGEX filter has invalid pattern: error parsing regexp: missing closing ): `(`",
+		},
+		{
+			query: MidQuery{Sort: []Sorting{{Key: "state", Order: "desc"}}},
+			err:   `/sort/0/order: sort order must be ASC or DESC, got "desc"`,
+		},
+		{
+			query: MidQuery{Aggregate: &Aggregation{Functions: []Aggregate{{Op: "SUM"}}}},
+			err:   "/aggregate/functions/0/key: SUM function requires a key",
+		},
+	}
+	for _, test := range tests {
+		err := test.query.Validate()
+		if len(test.err) == 0 {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, test.err)
+		}
+	}
+}
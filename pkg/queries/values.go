@@ -0,0 +1,242 @@
+package queries
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// parseValue verifies the filter value (see checkValue) and converts the time literals to Date
+func parseValue(t string, v interface{}) (interface{}, error) {
+	if m, ok := v.(map[string]interface{}); ok && len(m) == 1 {
+		if expr, ok := m[DATE]; ok {
+			return parseDate(t, expr)
+		}
+	}
+	return v, checkValue(t, v)
+}
+
+// checkValue verifies that the filter value is a scalar supported by all backends:
+// a string, a number, a boolean, a date or null
+func checkValue(t string, v interface{}) error {
+	switch v.(type) {
+	case nil, bool, string, json.Number, Date,
+		float32, float64,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64:
+		return nil
+	default:
+		return fmt.Errorf("%s filter has unsupported value type %T", t, v)
+	}
+}
+
+// LookupPath returns the value of the dotted key (e.g. "person.name") in the document
+func LookupPath(doc interface{}, key string) (interface{}, bool) {
+	val := doc
+	for _, field := range strings.Split(key, ".") {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if val, ok = m[field]; !ok {
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+// ToFloat converts a numeric value to float64
+func ToFloat(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case float32:
+		return float64(val), true
+	case int:
+		return float64(val), true
+	case int8:
+		return float64(val), true
+	case int16:
+		return float64(val), true
+	case int32:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case uint:
+		return float64(val), true
+	case uint8:
+		return float64(val), true
+	case uint16:
+		return float64(val), true
+	case uint32:
+		return float64(val), true
+	case uint64:
+		return float64(val), true
+	case json.Number:
+		f, err := val.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// value classes in sorting order
+const (
+	classNull = iota
+	classNumber
+	classString
+	classObject
+	classArray
+	classBool
+	classDate
+	classOther
+)
+
+func valueClass(v interface{}) int {
+	if _, ok := ToFloat(v); ok {
+		return classNumber
+	}
+	switch v.(type) {
+	case nil:
+		return classNull
+	case string:
+		return classString
+	case map[string]interface{}:
+		return classObject
+	case []interface{}:
+		return classArray
+	case bool:
+		return classBool
+	case Date, time.Time:
+		return classDate
+	default:
+		return classOther
+	}
+}
+
+// CompareScalars compares two values of the same kind (numbers, strings, booleans or dates).
+// A time literal of the filter (Date) is also comparable with RFC 3339 strings, in
+// which case both are compared as points in time, regardless of their timezones.
+// Other strings are compared as strings, even with a time value of the document.
+// The second return value is false when the values are not comparable.
+func CompareScalars(a, b interface{}) (int, bool) {
+	if isDate(a) || isDate(b) {
+		x, ok := toTime(a, isLiteral(b))
+		if !ok {
+			return 0, false
+		}
+		y, ok := toTime(b, isLiteral(a))
+		if !ok {
+			return 0, false
+		}
+		return compareTimes(x, y), true
+	}
+	if x, ok := ToFloat(a); ok {
+		y, ok := ToFloat(b)
+		if !ok {
+			return 0, false
+		}
+		return compareFloats(x, y), true
+	}
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case bool:
+		y, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x == y:
+			return 0, true
+		case y:
+			return -1, true
+		default:
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+// CompareValues defines a total order over document values for sorting.
+// Values of different kinds are ordered as in MongoDB:
+// null (or missing) < numbers < strings < objects < arrays < booleans.
+func CompareValues(a, b interface{}) int {
+	ca, cb := valueClass(a), valueClass(b)
+	if ca != cb {
+		return ca - cb
+	}
+	if ret, ok := CompareScalars(a, b); ok {
+		return ret
+	}
+	switch x := a.(type) {
+	case []interface{}:
+		y := b.([]interface{})
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if ret := CompareValues(x[i], y[i]); ret != 0 {
+				return ret
+			}
+		}
+		return len(x) - len(y)
+	case map[string]interface{}:
+		y := b.(map[string]interface{})
+		kx, ky := sortedKeys(x), sortedKeys(y)
+		for i := 0; i < len(kx) && i < len(ky); i++ {
+			if ret := strings.Compare(kx[i], ky[i]); ret != 0 {
+				return ret
+			}
+			if ret := CompareValues(x[kx[i]], y[ky[i]]); ret != 0 {
+				return ret
+			}
+		}
+		return len(kx) - len(ky)
+	}
+	return 0
+}
+
+func isDate(v interface{}) bool {
+	return valueClass(v) == classDate
+}
+
+// isLiteral reports whether the value is a time literal of a filter
+func isLiteral(v interface{}) bool {
+	_, ok := v.(Date)
+	return ok
+}
+
+func compareTimes(x, y time.Time) int {
+	switch {
+	case x.Before(y):
+		return -1
+	case x.After(y):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -4,12 +4,29 @@ import (
 	"fmt"
 )
 
+// Visitor translates the filter tree into a backend specific representation.
+// The value returned by each Visit method is opaque to the QueryBuilder and
+// is passed back to the visitor in Finalize.
 type Visitor interface {
-	VisitEQ(*FilterEQ) (string, error)
-	VisitIN(*FilterIN) (string, error)
-	VisitAND(*FilterAND) (string, error)
-	VisitOR(*FilterOR) (string, error)
-	Finalize(string, *MidQuery) error
+	VisitEQ(*FilterEQ) (interface{}, error)
+	VisitNE(*FilterNE) (interface{}, error)
+	VisitGT(*FilterGT) (interface{}, error)
+	VisitGTE(*FilterGTE) (interface{}, error)
+	VisitLT(*FilterLT) (interface{}, error)
+	VisitLTE(*FilterLTE) (interface{}, error)
+	VisitIN(*FilterIN) (interface{}, error)
+	VisitBETWEEN(*FilterBETWEEN) (interface{}, error)
+	VisitSTARTSWITH(*FilterSTARTSWITH) (interface{}, error)
+	VisitCONTAINS(*FilterCONTAINS) (interface{}, error)
+	VisitREGEX(*FilterREGEX) (interface{}, error)
+	VisitEXISTS(*FilterEXISTS) (interface{}, error)
+	VisitISNULL(*FilterISNULL) (interface{}, error)
+	VisitARRAYCONTAINS(*FilterARRAYCONTAINS) (interface{}, error)
+	VisitANY(*FilterANY) (interface{}, error)
+	VisitAND(*FilterAND) (interface{}, error)
+	VisitOR(*FilterOR) (interface{}, error)
+	VisitNOT(*FilterNOT) (interface{}, error)
+	Finalize(interface{}, *MidQuery) error
 }
 
 type QueryBuilder struct {
@@ -30,20 +47,53 @@ func (h *QueryBuilder) BuildQuery(mq *MidQuery) error {
 	return h.visitor.Finalize(filters, mq)
 }
 
-func (h *QueryBuilder) buildFilter(filter Filter) (string, error) {
+func (h *QueryBuilder) buildFilter(filter Filter) (interface{}, error) {
 	if filter == nil {
-		return "", nil
+		return nil, nil
 	}
+	return VisitFilter(h.visitor, filter)
+}
+
+// VisitFilter dispatches the filter to the matching method of the visitor
+func VisitFilter(visitor Visitor, filter Filter) (interface{}, error) {
 	switch f := filter.(type) {
 	case *FilterEQ:
-		return h.visitor.VisitEQ(f)
+		return visitor.VisitEQ(f)
+	case *FilterNE:
+		return visitor.VisitNE(f)
+	case *FilterGT:
+		return visitor.VisitGT(f)
+	case *FilterGTE:
+		return visitor.VisitGTE(f)
+	case *FilterLT:
+		return visitor.VisitLT(f)
+	case *FilterLTE:
+		return visitor.VisitLTE(f)
 	case *FilterIN:
-		return h.visitor.VisitIN(f)
+		return visitor.VisitIN(f)
+	case *FilterBETWEEN:
+		return visitor.VisitBETWEEN(f)
+	case *FilterSTARTSWITH:
+		return visitor.VisitSTARTSWITH(f)
+	case *FilterCONTAINS:
+		return visitor.VisitCONTAINS(f)
+	case *FilterREGEX:
+		return visitor.VisitREGEX(f)
+	case *FilterEXISTS:
+		return visitor.VisitEXISTS(f)
+	case *FilterISNULL:
+		return visitor.VisitISNULL(f)
+	case *FilterARRAYCONTAINS:
+		return visitor.VisitARRAYCONTAINS(f)
+	case *FilterANY:
+		return visitor.VisitANY(f)
 	case *FilterOR:
-		return h.visitor.VisitOR(f)
+		return visitor.VisitOR(f)
 	case *FilterAND:
-		return h.visitor.VisitAND(f)
+		return visitor.VisitAND(f)
+	case *FilterNOT:
+		return visitor.VisitNOT(f)
 	default:
-		return "", fmt.Errorf("Unsupported filter type %#v", filter)
+		return nil, fmt.Errorf("Unsupported filter type %#v", filter)
 	}
 }
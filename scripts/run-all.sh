@@ -29,11 +29,20 @@ docker run -it --rm -v $datadir:/data/db -p 27017:27017 --name mongodb -d mongo:
 echo "Populating DB"
 go run $DIR/cmd/docdb/main.go -c $DIR/cfg/mongodb.json -i $DIR/tests/dataset.json
 
-for f in tests/q1.json tests/q2.json tests/q3.json tests/q4.json; do
+for f in tests/q1.json tests/q2.json tests/q3.json tests/q4.json tests/q5.json tests/q6.json tests/q7.json tests/q8.json tests/q9.json tests/q10.json tests/q11.json tests/q12.json tests/q13.json tests/q14.json tests/q15.json; do
   echo "Query:"
   cat $DIR/$f
   go run $DIR/cmd/docdb/main.go -c $DIR/cfg/mongodb.json -q $DIR/$f
   echo
 done
 
+query='person.org = "A" OR (person.org = "B" AND state IN ("CA", "WA")) ORDER BY state DESC, person.name LIMIT 2'
+echo "Text query:"
+echo "$query"
+go run $DIR/cmd/docdb/main.go -c $DIR/cfg/mongodb.json -e "$query"
+echo
+
+echo "Running conformance tests"
+(cd $DIR && MONGODB_URL=mongodb://localhost:27017 go test ./pkg/mongodb -run Conformance -count=1)
+
 echo "Done"